@@ -10,6 +10,7 @@ import (
 func main() {
 	server := server.NewFiberServer()
 	server.RegisterRoutes()
+	server.StartBackgroundJobs()
 	port := ":" + os.Getenv("PORT")
 	if err := server.Listen(port); err != nil {
 		log.Fatal("couldn't start the server. error:", err)
@@ -2,12 +2,34 @@ package database
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	_ "github.com/lib/pq"
 	"log"
 	"os"
 )
 
+var (
+	ErrBookNotFound      = errors.New("book not found")
+	ErrBookNotInCart     = errors.New("book not found in cart")
+	ErrInsufficientStock = errors.New("insufficient stock")
+	ErrEmptyCart         = errors.New("cart is empty")
+	ErrCartChanged       = errors.New("cart changed since shipping was quoted")
+
+	ErrOrderNotFound           = errors.New("order not found")
+	ErrInvalidStatusTransition = errors.New("cannot move order")
+
+	ErrIsbnConflict = errors.New("isbn is already used by another book")
+
+	ErrReviewExists   = errors.New("review already exists")
+	ErrReviewReported = errors.New("review already reported")
+	ErrReviewChanged  = errors.New("review was edited since it was loaded")
+
+	ErrCategoryNotFound       = errors.New("category not found")
+	ErrParentCategoryNotFound = errors.New("parent category not found")
+	ErrCategoryCycle          = errors.New("category cannot be moved under itself or its subcategories")
+)
+
 type DBService struct {
 	db *sql.DB
 }
@@ -40,3 +62,9 @@ func NewDBService() *DBService {
 	}
 	return instance
 }
+
+// NewDBServiceWithDB wraps an already opened connection pool, e.g. one from
+// dbtest.
+func NewDBServiceWithDB(db *sql.DB) *DBService {
+	return &DBService{db: db}
+}
@@ -0,0 +1,11 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE users
+    ADD COLUMN role varchar(32) NOT NULL DEFAULT 'customer'
+    CHECK (role IN ('customer', 'staff', 'admin'));
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE users DROP COLUMN role;
+-- +goose StatementEnd
@@ -0,0 +1,25 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE token_families (
+    id serial PRIMARY KEY,
+    user_id int NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    created_at timestamp NOT NULL DEFAULT NOW(),
+    revoked_at timestamp
+);
+
+CREATE TABLE refresh_tokens (
+    id serial PRIMARY KEY,
+    family_id int NOT NULL REFERENCES token_families(id) ON DELETE CASCADE,
+    token_hash varchar(64) UNIQUE NOT NULL, -- sha256 hex digest, the raw token is never stored
+    expires_at timestamp NOT NULL,
+    used_at timestamp
+);
+
+CREATE INDEX token_families_user_id_idx ON token_families(user_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS refresh_tokens;
+DROP TABLE IF EXISTS token_families;
+-- +goose StatementEnd
@@ -0,0 +1,16 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE password_reset_tokens (
+    id serial PRIMARY KEY,
+    user_id int NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    token_hash varchar(64) UNIQUE NOT NULL, -- sha256 hex digest, the raw token is only mailed
+    created_at timestamp NOT NULL DEFAULT NOW(),
+    expires_at timestamp NOT NULL,
+    used_at timestamp
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE password_reset_tokens;
+-- +goose StatementEnd
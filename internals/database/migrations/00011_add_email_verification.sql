@@ -0,0 +1,19 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE users ADD COLUMN verified_at timestamp;
+
+CREATE TABLE email_verification_tokens (
+    id serial PRIMARY KEY,
+    user_id int NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    token_hash varchar(64) UNIQUE NOT NULL, -- sha256 hex digest, the raw token is only mailed
+    created_at timestamp NOT NULL DEFAULT NOW(),
+    expires_at timestamp NOT NULL,
+    used_at timestamp
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE email_verification_tokens;
+ALTER TABLE users DROP COLUMN verified_at;
+-- +goose StatementEnd
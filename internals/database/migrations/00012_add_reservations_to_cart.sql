@@ -0,0 +1,27 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE cart ADD COLUMN reserved_until timestamp NOT NULL DEFAULT NOW();
+
+-- cart lines used to take stock from books directly, give it back since
+-- they are now only reservations on top of the on-hand quantity.
+UPDATE books b
+SET quantity = b.quantity + c.quantity
+FROM (SELECT book_id, SUM(quantity) AS quantity FROM cart GROUP BY book_id) c
+WHERE c.book_id = b.id;
+
+UPDATE cart SET reserved_until = NOW() + INTERVAL '30 minutes';
+
+CREATE INDEX cart_book_id_reserved_until_idx ON cart(book_id, reserved_until);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX cart_book_id_reserved_until_idx;
+
+UPDATE books b
+SET quantity = GREATEST(b.quantity - c.quantity, 0)
+FROM (SELECT book_id, SUM(quantity) AS quantity FROM cart GROUP BY book_id) c
+WHERE c.book_id = b.id;
+
+ALTER TABLE cart DROP COLUMN reserved_until;
+-- +goose StatementEnd
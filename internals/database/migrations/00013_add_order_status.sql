@@ -0,0 +1,26 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE orders
+    ADD COLUMN status varchar(32) NOT NULL DEFAULT 'pending'
+    CHECK (status IN ('pending', 'paid', 'shipped', 'delivered', 'cancelled'));
+
+CREATE TABLE order_status_history (
+    id serial PRIMARY KEY,
+    order_id int NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
+    from_status varchar(32), -- NULL for the initial status
+    to_status varchar(32) NOT NULL,
+    changed_by int REFERENCES users(id) ON DELETE SET NULL,
+    changed_at timestamp NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX order_status_history_order_id_idx ON order_status_history(order_id);
+
+INSERT INTO order_status_history (order_id, to_status, changed_by, changed_at)
+SELECT id, status, user_id, applied_at FROM orders;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE order_status_history;
+ALTER TABLE orders DROP COLUMN status;
+-- +goose StatementEnd
@@ -0,0 +1,36 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE orders DROP CONSTRAINT orders_status_check;
+UPDATE orders SET status = 'pending_payment' WHERE status = 'pending';
+UPDATE order_status_history SET from_status = 'pending_payment' WHERE from_status = 'pending';
+UPDATE order_status_history SET to_status = 'pending_payment' WHERE to_status = 'pending';
+ALTER TABLE orders
+    ALTER COLUMN status SET DEFAULT 'pending_payment',
+    ADD CONSTRAINT orders_status_check
+    CHECK (status IN ('pending_payment', 'paid', 'shipped', 'delivered', 'cancelled'));
+
+CREATE TABLE payments (
+    id serial PRIMARY KEY,
+    order_id int UNIQUE NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
+    provider_ref varchar(255), -- the gateway's payment id, NULL until authorized
+    amount numeric(10,2) NOT NULL,
+    status varchar(32) NOT NULL
+        CHECK (status IN ('pending', 'authorized', 'captured', 'declined', 'refunded')),
+    created_at timestamp NOT NULL DEFAULT NOW(),
+    updated_at timestamp NOT NULL DEFAULT NOW()
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE payments;
+
+ALTER TABLE orders DROP CONSTRAINT orders_status_check;
+UPDATE orders SET status = 'pending' WHERE status = 'pending_payment';
+UPDATE order_status_history SET from_status = 'pending' WHERE from_status = 'pending_payment';
+UPDATE order_status_history SET to_status = 'pending' WHERE to_status = 'pending_payment';
+ALTER TABLE orders
+    ALTER COLUMN status SET DEFAULT 'pending',
+    ADD CONSTRAINT orders_status_check
+    CHECK (status IN ('pending', 'paid', 'shipped', 'delivered', 'cancelled'));
+-- +goose StatementEnd
@@ -0,0 +1,19 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE books ADD COLUMN weight_grams int NOT NULL DEFAULT 500 CHECK (weight_grams > 0);
+
+ALTER TABLE orders
+    ADD COLUMN shipping_service varchar(64),
+    ADD COLUMN shipping_cost numeric(10,2) NOT NULL DEFAULT 0,
+    ADD COLUMN tracking_number varchar(255);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE orders
+    DROP COLUMN shipping_service,
+    DROP COLUMN shipping_cost,
+    DROP COLUMN tracking_number;
+
+ALTER TABLE books DROP COLUMN weight_grams;
+-- +goose StatementEnd
@@ -0,0 +1,20 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE idempotency_keys (
+    user_id int NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    key varchar(255) NOT NULL,
+    request_hash varchar(64) NOT NULL, -- sha256 hex digest of method, path and body
+    status_code int,                   -- NULL while the first request is in flight
+    content_type varchar(255),
+    response_body bytea,
+    created_at timestamp NOT NULL DEFAULT NOW(),
+    PRIMARY KEY(user_id, key)
+);
+
+CREATE INDEX idempotency_keys_created_at_idx ON idempotency_keys(created_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE idempotency_keys;
+-- +goose StatementEnd
@@ -0,0 +1,24 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE authors (
+    id serial PRIMARY KEY,
+    name varchar(255) NOT NULL,
+    bio text NOT NULL DEFAULT ''
+);
+
+-- position keeps the order authors are credited in
+CREATE TABLE book_authors (
+    book_id int NOT NULL REFERENCES books(id) ON DELETE CASCADE,
+    author_id int NOT NULL REFERENCES authors(id) ON DELETE CASCADE,
+    position int NOT NULL DEFAULT 0,
+    PRIMARY KEY (book_id, author_id)
+);
+
+CREATE INDEX book_authors_author_id_idx ON book_authors (author_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE book_authors;
+DROP TABLE authors;
+-- +goose StatementEnd
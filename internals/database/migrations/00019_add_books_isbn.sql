@@ -0,0 +1,18 @@
+-- +goose Up
+-- +goose StatementBegin
+-- isbn13 is the normalized identifier; isbn10 is derived from it when the
+-- book has one (978 prefix)
+ALTER TABLE books
+    ADD COLUMN isbn10 varchar(10),
+    ADD COLUMN isbn13 varchar(13);
+
+CREATE UNIQUE INDEX books_isbn13_idx ON books (isbn13);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX books_isbn13_idx;
+ALTER TABLE books
+    DROP COLUMN isbn10,
+    DROP COLUMN isbn13;
+-- +goose StatementEnd
@@ -0,0 +1,20 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE reviews (
+    id serial PRIMARY KEY,
+    user_id int NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    book_id int NOT NULL REFERENCES books(id) ON DELETE CASCADE,
+    rating smallint NOT NULL CHECK (rating >= 1 AND rating <= 5),
+    text text NOT NULL DEFAULT '',
+    created_at timestamp NOT NULL DEFAULT NOW(),
+    updated_at timestamp NOT NULL DEFAULT NOW(),
+    UNIQUE (user_id, book_id)
+);
+
+CREATE INDEX reviews_book_id_created_at_idx ON reviews (book_id, created_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE reviews;
+-- +goose StatementEnd
@@ -0,0 +1,34 @@
+-- +goose Up
+-- +goose StatementBegin
+-- reviews written before moderation stay visible
+ALTER TABLE reviews
+    ADD COLUMN status varchar(16) NOT NULL DEFAULT 'approved'
+        CHECK (status IN ('pending', 'approved', 'rejected')),
+    ADD COLUMN flagged_words text[] NOT NULL DEFAULT '{}',
+    ADD COLUMN moderated_by int REFERENCES users(id) ON DELETE SET NULL,
+    ADD COLUMN moderated_at timestamp;
+
+ALTER TABLE reviews ALTER COLUMN status SET DEFAULT 'pending';
+
+CREATE INDEX reviews_status_created_at_idx ON reviews (status, created_at);
+
+CREATE TABLE review_reports (
+    id serial PRIMARY KEY,
+    review_id int NOT NULL REFERENCES reviews(id) ON DELETE CASCADE,
+    user_id int NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    reason text NOT NULL,
+    created_at timestamp NOT NULL DEFAULT NOW(),
+    UNIQUE (review_id, user_id)
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE review_reports;
+DROP INDEX reviews_status_created_at_idx;
+ALTER TABLE reviews
+    DROP COLUMN status,
+    DROP COLUMN flagged_words,
+    DROP COLUMN moderated_by,
+    DROP COLUMN moderated_at;
+-- +goose StatementEnd
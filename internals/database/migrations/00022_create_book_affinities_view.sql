@@ -0,0 +1,23 @@
+-- +goose Up
+-- +goose StatementBegin
+-- how many (not cancelled) orders had both books. refreshed periodically by
+-- the server, see RefreshBookAffinities
+CREATE MATERIALIZED VIEW book_affinities AS
+SELECT
+    a.book_id,
+    b.book_id AS related_book_id,
+    COUNT(*) AS orders
+FROM order_book a
+JOIN order_book b ON b.order_id = a.order_id AND b.book_id <> a.book_id
+JOIN orders ON orders.id = a.order_id
+WHERE orders.status <> 'cancelled'
+GROUP BY a.book_id, b.book_id;
+
+-- also required to refresh concurrently
+CREATE UNIQUE INDEX book_affinities_pair_idx ON book_affinities (book_id, related_book_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP MATERIALIZED VIEW book_affinities;
+-- +goose StatementEnd
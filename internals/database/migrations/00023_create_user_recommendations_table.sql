@@ -0,0 +1,19 @@
+-- +goose Up
+-- +goose StatementBegin
+-- filled by the server's recommendations job, see RefreshUserRecommendations
+CREATE TABLE user_recommendations (
+    user_id int NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    book_id int NOT NULL REFERENCES books(id) ON DELETE CASCADE,
+    score float8 NOT NULL,
+    rank int NOT NULL,
+    computed_at timestamp NOT NULL,
+    PRIMARY KEY (user_id, book_id)
+);
+
+CREATE INDEX user_recommendations_user_id_rank_idx ON user_recommendations (user_id, rank);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE user_recommendations;
+-- +goose StatementEnd
@@ -0,0 +1,13 @@
+-- +goose Up
+-- +goose StatementBegin
+-- subcategories of a deleted category become top-level categories
+ALTER TABLE categories ADD COLUMN parent_id int REFERENCES categories(id) ON DELETE SET NULL;
+
+CREATE INDEX categories_parent_id_idx ON categories (parent_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX categories_parent_id_idx;
+ALTER TABLE categories DROP COLUMN parent_id;
+-- +goose StatementEnd
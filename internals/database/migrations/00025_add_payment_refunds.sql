@@ -0,0 +1,22 @@
+-- +goose Up
+-- +goose StatementBegin
+-- refund_pending and void_pending mark payments of cancelled orders whose
+-- money the gateway still has to give back
+ALTER TABLE payments DROP CONSTRAINT payments_status_check;
+ALTER TABLE payments ADD CONSTRAINT payments_status_check
+    CHECK (status IN ('pending', 'authorized', 'captured', 'declined', 'refund_pending', 'refunded', 'void_pending', 'voided'));
+
+CREATE INDEX payments_unsettled_idx ON payments (updated_at)
+    WHERE status IN ('refund_pending', 'void_pending');
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX payments_unsettled_idx;
+UPDATE payments SET status = 'captured' WHERE status = 'refund_pending';
+UPDATE payments SET status = 'authorized' WHERE status = 'void_pending';
+UPDATE payments SET status = 'declined' WHERE status = 'voided';
+ALTER TABLE payments DROP CONSTRAINT payments_status_check;
+ALTER TABLE payments ADD CONSTRAINT payments_status_check
+    CHECK (status IN ('pending', 'authorized', 'captured', 'declined', 'refunded'));
+-- +goose StatementEnd
@@ -1,11 +1,16 @@
 package database
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/assaidy/bookstore/internals/models"
+	"github.com/lib/pq"
 )
 
 // --------------------------------------------------
@@ -41,10 +46,18 @@ func (dbs *DBService) checkRow(query string, args ...any) (bool, error) {
 	return true, nil
 }
 
+// isUniqueViolation reports whether err is postgres rejecting a row that breaks
+// the named unique constraint or index. the Check* methods can't rule these
+// out, a concurrent request may insert the same row right after them.
+func isUniqueViolation(err error, constraint string) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505" && pqErr.Constraint == constraint
+}
+
 func (dbs *DBService) CreateUser(inout *models.User) error {
 	query := `
-    INSERT INTO users(name, username, password, email, address, joined_at)
-    VALUES($1, $2, $3, $4, $5, $6)
+    INSERT INTO users(name, username, password, email, address, role, joined_at)
+    VALUES($1, $2, $3, $4, $5, $6, $7)
     RETURNING id;
     `
 	if err := dbs.db.QueryRow(
@@ -54,6 +67,7 @@ func (dbs *DBService) CreateUser(inout *models.User) error {
 		inout.Password,
 		inout.Email,
 		inout.Address,
+		inout.Role,
 		inout.JoinedAt,
 	).Scan(&inout.Id); err != nil {
 		return err
@@ -69,13 +83,15 @@ func (dbs *DBService) GetUserById(id int) (*models.User, error) {
         username,
         password,
         address,
-        joined_at
+        role,
+        joined_at,
+        verified_at
     FROM users
     WHERE id = $1;
     `
 	user := models.User{Id: id}
 	if err := dbs.db.QueryRow(query, id).Scan(
-		&user.Name, &user.Email, &user.Username, &user.Password, &user.Address, &user.JoinedAt); err != nil {
+		&user.Name, &user.Email, &user.Username, &user.Password, &user.Address, &user.Role, &user.JoinedAt, &user.VerifiedAt); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, nil
 		}
@@ -92,13 +108,40 @@ func (dbs *DBService) GetUserByUsername(username string) (*models.User, error) {
         email,
         password,
         Address,
-        joined_at
+        role,
+        joined_at,
+        verified_at
     FROM users
     WHERE username = $1;
     `
 	user := models.User{Username: username}
 	if err := dbs.db.QueryRow(query, username).Scan(
-		&user.Id, &user.Name, &user.Email, &user.Password, &user.Address, &user.JoinedAt); err != nil {
+		&user.Id, &user.Name, &user.Email, &user.Password, &user.Address, &user.Role, &user.JoinedAt, &user.VerifiedAt); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (dbs *DBService) GetUserByEmail(email string) (*models.User, error) {
+	query := `
+    SELECT
+        id,
+        name,
+        username,
+        password,
+        address,
+        role,
+        joined_at,
+        verified_at
+    FROM users
+    WHERE email = $1;
+    `
+	user := models.User{Email: email}
+	if err := dbs.db.QueryRow(query, email).Scan(
+		&user.Id, &user.Name, &user.Username, &user.Password, &user.Address, &user.Role, &user.JoinedAt, &user.VerifiedAt); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, nil
 		}
@@ -115,7 +158,9 @@ func (dbs *DBService) GetAllUsers() ([]*models.User, error) {
         username,
         email,
         Address,
-        joined_at
+        role,
+        joined_at,
+        verified_at
     FROM users;
     `
 	rows, err := dbs.db.Query(query)
@@ -134,7 +179,9 @@ func (dbs *DBService) GetAllUsers() ([]*models.User, error) {
 			&user.Username,
 			&user.Email,
 			&user.Address,
+			&user.Role,
 			&user.JoinedAt,
+			&user.VerifiedAt,
 		); err != nil {
 			return nil, err
 		}
@@ -147,7 +194,16 @@ func (dbs *DBService) GetAllUsers() ([]*models.User, error) {
 	return users, nil
 }
 
-func (dbs *DBService) UpdateUser(newUser *models.User) error {
+// UpdateUser saves the user. when passwordChanged is set, every session of
+// the user except keepFamilyId (0 to keep none) is revoked in the same
+// transaction, so a leaked refresh token stops working with the old password.
+func (dbs *DBService) UpdateUser(newUser *models.User, passwordChanged bool, keepFamilyId int) error {
+	tx, err := dbs.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
 	query := `
     UPDATE users
     SET 
@@ -155,21 +211,42 @@ func (dbs *DBService) UpdateUser(newUser *models.User) error {
         username = $2,
         email = $3,
         password = $4,
-        address = $5
-    WHERE id = $6;
+        address = $5,
+        verified_at = $6
+    WHERE id = $7;
     `
-	if _, err := dbs.db.Exec(
+	if _, err := tx.Exec(
 		query,
 		newUser.Name,
 		newUser.Username,
 		newUser.Email,
 		newUser.Password,
 		newUser.Address,
+		newUser.VerifiedAt,
 		newUser.Id,
 	); err != nil {
 		return err
 	}
 
+	if passwordChanged {
+		query = `
+        UPDATE token_families
+        SET revoked_at = $1
+        WHERE user_id = $2 AND id <> $3 AND revoked_at IS NULL;
+        `
+		if _, err := tx.Exec(query, time.Now().UTC(), newUser.Id, keepFamilyId); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (dbs *DBService) UpdateUserRole(id int, role string) error {
+	query := `UPDATE users SET role = $1 WHERE id = $2;`
+	if _, err := dbs.db.Exec(query, role, id); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -181,6 +258,236 @@ func (dbs *DBService) DeleteUser(id int) error {
 	return nil
 }
 
+// --------------------------------------------------
+// > token
+// --------------------------------------------------
+func (dbs *DBService) CreateTokenFamily(uid int) (int, error) {
+	query := `INSERT INTO token_families (user_id, created_at) VALUES ($1, $2) RETURNING id;`
+	var fid int
+	if err := dbs.db.QueryRow(query, uid, time.Now().UTC()).Scan(&fid); err != nil {
+		return 0, err
+	}
+	return fid, nil
+}
+
+func (dbs *DBService) CheckIfTokenFamilyActive(fid int) (bool, error) {
+	query := `SELECT 1 FROM token_families WHERE id = $1 AND revoked_at IS NULL LIMIT 1;`
+	return dbs.checkRow(query, fid)
+}
+
+func (dbs *DBService) RevokeTokenFamily(fid int) error {
+	query := `UPDATE token_families SET revoked_at = $1 WHERE id = $2 AND revoked_at IS NULL;`
+	if _, err := dbs.db.Exec(query, time.Now().UTC(), fid); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (dbs *DBService) RevokeAllUserTokenFamilies(uid int) error {
+	query := `UPDATE token_families SET revoked_at = $1 WHERE user_id = $2 AND revoked_at IS NULL;`
+	if _, err := dbs.db.Exec(query, time.Now().UTC(), uid); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (dbs *DBService) CreateRefreshToken(inout *models.RefreshToken) error {
+	query := `
+    INSERT INTO refresh_tokens (family_id, token_hash, expires_at)
+    VALUES ($1, $2, $3)
+    RETURNING id;
+    `
+	if err := dbs.db.QueryRow(
+		query,
+		inout.FamilyId,
+		inout.TokenHash,
+		inout.ExpiresAt,
+	).Scan(&inout.Id); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (dbs *DBService) GetRefreshTokenByHash(hash string) (*models.RefreshToken, error) {
+	query := `
+    SELECT
+        rt.id,
+        rt.family_id,
+        tf.user_id,
+        rt.expires_at,
+        rt.used_at,
+        tf.revoked_at IS NOT NULL
+    FROM refresh_tokens rt
+    JOIN token_families tf ON tf.id = rt.family_id
+    WHERE rt.token_hash = $1;
+    `
+	rt := models.RefreshToken{TokenHash: hash}
+	if err := dbs.db.QueryRow(query, hash).Scan(
+		&rt.Id,
+		&rt.FamilyId,
+		&rt.UserId,
+		&rt.ExpiresAt,
+		&rt.UsedAt,
+		&rt.FamilyRevoked,
+	); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &rt, nil
+}
+
+// UseRefreshToken marks the token as used. it reports false if the token was
+// already used, which means it is being replayed.
+func (dbs *DBService) UseRefreshToken(id int) (bool, error) {
+	query := `UPDATE refresh_tokens SET used_at = $1 WHERE id = $2 AND used_at IS NULL;`
+	res, err := dbs.db.Exec(query, time.Now().UTC(), id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// CreatePasswordResetToken stores a new reset token for the user and
+// invalidates any older ones that were not used yet.
+func (dbs *DBService) CreatePasswordResetToken(uid int, tokenHash string, expiresAt time.Time) error {
+	tx, err := dbs.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+
+	query := `UPDATE password_reset_tokens SET used_at = $1 WHERE user_id = $2 AND used_at IS NULL;`
+	if _, err := tx.Exec(query, now, uid); err != nil {
+		return err
+	}
+
+	query = `
+    INSERT INTO password_reset_tokens (user_id, token_hash, created_at, expires_at)
+    VALUES ($1, $2, $3, $4);
+    `
+	if _, err := tx.Exec(query, uid, tokenHash, now, expiresAt); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ResetPassword consumes the reset token, sets the new password and revokes
+// every session of the user. it reports false if the token is unknown, used or
+// expired.
+func (dbs *DBService) ResetPassword(tokenHash, hashedPassword string) (bool, error) {
+	tx, err := dbs.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+
+	query := `
+    UPDATE password_reset_tokens
+    SET used_at = $1
+    WHERE token_hash = $2 AND used_at IS NULL AND expires_at > $1
+    RETURNING user_id;
+    `
+	var uid int
+	if err := tx.QueryRow(query, now, tokenHash).Scan(&uid); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	query = `UPDATE users SET password = $1 WHERE id = $2;`
+	if _, err := tx.Exec(query, hashedPassword, uid); err != nil {
+		return false, err
+	}
+
+	query = `UPDATE token_families SET revoked_at = $1 WHERE user_id = $2 AND revoked_at IS NULL;`
+	if _, err := tx.Exec(query, now, uid); err != nil {
+		return false, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (dbs *DBService) CreateEmailVerificationToken(uid int, tokenHash string, expiresAt time.Time) error {
+	tx, err := dbs.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+
+	query := `UPDATE email_verification_tokens SET used_at = $1 WHERE user_id = $2 AND used_at IS NULL;`
+	if _, err := tx.Exec(query, now, uid); err != nil {
+		return err
+	}
+
+	query = `
+    INSERT INTO email_verification_tokens (user_id, token_hash, created_at, expires_at)
+    VALUES ($1, $2, $3, $4);
+    `
+	if _, err := tx.Exec(query, uid, tokenHash, now, expiresAt); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// VerifyEmail consumes the verification token and marks the user's email as
+// verified. it reports false if the token is unknown, used or expired.
+func (dbs *DBService) VerifyEmail(tokenHash string) (bool, error) {
+	tx, err := dbs.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+
+	query := `
+    UPDATE email_verification_tokens
+    SET used_at = $1
+    WHERE token_hash = $2 AND used_at IS NULL AND expires_at > $1
+    RETURNING user_id;
+    `
+	var uid int
+	if err := tx.QueryRow(query, now, tokenHash).Scan(&uid); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	query = `UPDATE users SET verified_at = $1 WHERE id = $2 AND verified_at IS NULL;`
+	if _, err := tx.Exec(query, now, uid); err != nil {
+		return false, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (dbs *DBService) CheckIfUserVerified(id int) (bool, error) {
+	query := `SELECT 1 FROM users WHERE id = $1 AND verified_at IS NOT NULL LIMIT 1;`
+	return dbs.checkRow(query, id)
+}
+
 // --------------------------------------------------
 // > category
 // --------------------------------------------------
@@ -196,18 +503,18 @@ func (dbs *DBService) CheckIfCategoryExists(id int) (bool, error) {
 
 func (dbs *DBService) CreateCategory(inout *models.Category) error {
 	query := `
-    INSERT INTO categories(name)
-    VALUES($1)
+    INSERT INTO categories(name, parent_id)
+    VALUES($1, $2)
     RETURNING id;
     `
-	if err := dbs.db.QueryRow(query, inout.Name).Scan(&inout.Id); err != nil {
+	if err := dbs.db.QueryRow(query, inout.Name, inout.ParentId).Scan(&inout.Id); err != nil {
 		return err
 	}
 	return nil
 }
 
 func (dbs *DBService) GetAllCategories() ([]*models.Category, error) {
-	query := `SELECT id, name FROM categories;`
+	query := `SELECT id, name, parent_id FROM categories ORDER BY name, id;`
 	rows, err := dbs.db.Query(query)
 	if err != nil {
 		return nil, err
@@ -218,7 +525,7 @@ func (dbs *DBService) GetAllCategories() ([]*models.Category, error) {
 
 	for rows.Next() {
 		cat := models.Category{}
-		if err := rows.Scan(&cat.Id, &cat.Name); err != nil {
+		if err := rows.Scan(&cat.Id, &cat.Name, &cat.ParentId); err != nil {
 			return nil, err
 		}
 		cats = append(cats, &cat)
@@ -231,9 +538,9 @@ func (dbs *DBService) GetAllCategories() ([]*models.Category, error) {
 }
 
 func (dbs *DBService) GetCategoryById(id int) (*models.Category, error) {
-	query := `SELECT name FROM categories WHERE id = $1;`
+	query := `SELECT name, parent_id FROM categories WHERE id = $1;`
 	cat := models.Category{Id: id}
-	if err := dbs.db.QueryRow(query, id).Scan(&cat.Name); err != nil {
+	if err := dbs.db.QueryRow(query, id).Scan(&cat.Name, &cat.ParentId); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, nil
 		}
@@ -250,6 +557,93 @@ func (dbs *DBService) UpdateCategory(cat *models.Category) error {
 	return nil
 }
 
+// categoryDescendantsQuery selects the ids of category $1 and all its
+// subcategories, at any depth.
+const categoryDescendantsQuery = `
+    WITH RECURSIVE tree AS (
+        SELECT id FROM categories WHERE id = $1
+        UNION
+        SELECT categories.id FROM categories JOIN tree ON categories.parent_id = tree.id
+    )
+    SELECT id FROM tree
+    `
+
+// GetCategoryDescendantIds returns the ids of the category and all its
+// subcategories.
+func (dbs *DBService) GetCategoryDescendantIds(id int) ([]int, error) {
+	rows, err := dbs.db.Query(categoryDescendantsQuery, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make([]int, 0)
+
+	for rows.Next() {
+		var cid int
+		if err := rows.Scan(&cid); err != nil {
+			return nil, err
+		}
+		ids = append(ids, cid)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
+
+// MoveCategory puts the category under the parent, or at the top level when
+// parentId is nil. moving a category under itself or one of its subcategories
+// fails with ErrCategoryCycle, a missing parent with ErrParentCategoryNotFound
+// and a missing category with ErrCategoryNotFound.
+func (dbs *DBService) MoveCategory(id int, parentId *int) error {
+	tx, err := dbs.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// concurrent moves could otherwise form a cycle together
+	query := `LOCK TABLE categories IN SHARE ROW EXCLUSIVE MODE;`
+	if _, err := tx.Exec(query); err != nil {
+		return err
+	}
+
+	if parentId != nil {
+		query = `SELECT 1 FROM categories WHERE id = $1;`
+		var one int
+		if err := tx.QueryRow(query, *parentId).Scan(&one); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return fmt.Errorf("%w: id %d", ErrParentCategoryNotFound, *parentId)
+			}
+			return err
+		}
+
+		query = `SELECT EXISTS (` + categoryDescendantsQuery + ` WHERE id = $2);`
+		var cycle bool
+		if err := tx.QueryRow(query, id, *parentId).Scan(&cycle); err != nil {
+			return err
+		}
+		if cycle {
+			return ErrCategoryCycle
+		}
+	}
+
+	query = `UPDATE categories SET parent_id = $1 WHERE id = $2;`
+	res, err := tx.Exec(query, parentId, id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return fmt.Errorf("%w: category with id %d", ErrCategoryNotFound, id)
+	}
+
+	return tx.Commit()
+}
+
 func (dbs *DBService) DeleteCategory(id int) error {
 	query := `DELETE FROM categories WHERE id = $1;`
 	if _, err := dbs.db.Exec(query, id); err != nil {
@@ -259,51 +653,81 @@ func (dbs *DBService) DeleteCategory(id int) error {
 }
 
 // --------------------------------------------------
-// > cover
+// > author
 // --------------------------------------------------
-func (dbs *DBService) CreateCover(inout *models.Cover) error {
+func (dbs *DBService) CheckIfAuthorExists(id int) (bool, error) {
+	query := `SELECT 1 FROM authors WHERE id = $1 LIMIT 1;`
+	return dbs.checkRow(query, id)
+}
+
+// CheckIfAuthorsExist reports whether every one of the distinct ids is an author.
+func (dbs *DBService) CheckIfAuthorsExist(ids []int) (bool, error) {
+	query := `SELECT COUNT(*) FROM authors WHERE id = ANY($1);`
+	var count int
+	if err := dbs.db.QueryRow(query, pq.Array(ids)).Scan(&count); err != nil {
+		return false, err
+	}
+	return count == len(ids), nil
+}
+
+func (dbs *DBService) CreateAuthor(inout *models.Author) error {
 	query := `
-    INSERT INTO covers (encoding, content)
-    VALUES ($1, $2)
+    INSERT INTO authors(name, bio)
+    VALUES($1, $2)
     RETURNING id;
     `
-	if err := dbs.db.QueryRow(
-		query,
-		inout.Encoding,
-		inout.Content,
-	).Scan(&inout.Id); err != nil {
+	if err := dbs.db.QueryRow(query, inout.Name, inout.Bio).Scan(&inout.Id); err != nil {
 		return err
 	}
 	return nil
 }
 
-func (dbs *DBService) GetCoverById(id int) (*models.Cover, error) {
-	query := `SELECT encoding, content FROM covers WHERE id = $1;`
-	cov := models.Cover{Id: id}
-	if err := dbs.db.QueryRow(query, id).Scan(&cov.Encoding, &cov.Content); err != nil {
+func (dbs *DBService) GetAllAuthors() ([]*models.Author, error) {
+	query := `SELECT id, name, bio FROM authors ORDER BY name, id;`
+	rows, err := dbs.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	authors := make([]*models.Author, 0)
+
+	for rows.Next() {
+		author := models.Author{}
+		if err := rows.Scan(&author.Id, &author.Name, &author.Bio); err != nil {
+			return nil, err
+		}
+		authors = append(authors, &author)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return authors, nil
+}
+
+func (dbs *DBService) GetAuthorById(id int) (*models.Author, error) {
+	query := `SELECT name, bio FROM authors WHERE id = $1;`
+	author := models.Author{Id: id}
+	if err := dbs.db.QueryRow(query, id).Scan(&author.Name, &author.Bio); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, nil
 		}
 		return nil, err
 	}
-	return &cov, nil
+	return &author, nil
 }
 
-func (dbs *DBService) UpdateCover(cov *models.Cover) error {
-	query := `UPDATE covers SET encoding = $1, content = $2 WHERE id = $3;`
-	if _, err := dbs.db.Exec(query, cov.Encoding, cov.Content, cov.Id); err != nil {
+func (dbs *DBService) UpdateAuthor(author *models.Author) error {
+	query := `UPDATE authors SET name = $1, bio = $2 WHERE id = $3;`
+	if _, err := dbs.db.Exec(query, author.Name, author.Bio, author.Id); err != nil {
 		return err
 	}
 	return nil
 }
 
-func (dbs *DBService) CheckIfCoverExists(id int) (bool, error) {
-	query := `SELECT 1 FROM covers WHERE id = $1 LIMIT 1;`
-	return dbs.checkRow(query, id)
-}
-
-func (dbs *DBService) DeleteCover(id int) error {
-	query := `DELETE FROM covers WHERE id = $1;`
+func (dbs *DBService) DeleteAuthor(id int) error {
+	query := `DELETE FROM authors WHERE id = $1;`
 	if _, err := dbs.db.Exec(query, id); err != nil {
 		return err
 	}
@@ -311,113 +735,174 @@ func (dbs *DBService) DeleteCover(id int) error {
 }
 
 // --------------------------------------------------
-// > book
+// > cover
 // --------------------------------------------------
-func (dbs *DBService) CreateBook(inout *models.Book) error {
+func (dbs *DBService) CreateCover(inout *models.Cover) error {
 	query := `
-    INSERT INTO books(
-        title,
-        description,
-        category_id,
-        cover_id,
-        price,
-        quantity,
-        discount,
-        added_at
-    )
-    VALUES($1, $2, $3, $4, $5, $6, $7, $8)
+    INSERT INTO covers (encoding, content)
+    VALUES ($1, $2)
     RETURNING id;
     `
 	if err := dbs.db.QueryRow(
 		query,
-		inout.Title,
-		inout.Description,
-		inout.CategoryId,
-		inout.CoverId,
-		inout.Price,
-		inout.Quantity,
-		inout.Discount,
-		inout.AddedAt,
+		inout.Encoding,
+		inout.Content,
 	).Scan(&inout.Id); err != nil {
 		return err
 	}
 	return nil
 }
 
-func (dbs *DBService) GetBookById(id int) (*models.Book, error) {
-	query := `
-    SELECT
-        title,
-        description,
-        category_id,
-        cover_id,
-        price,
-        quantity,
-        discount,
-        added_at,
-        purchase_count
-    FROM books
-    WHERE id = $1;
+func (dbs *DBService) GetCoverById(id int) (*models.Cover, error) {
+	query := `SELECT encoding, content FROM covers WHERE id = $1;`
+	cov := models.Cover{Id: id}
+	if err := dbs.db.QueryRow(query, id).Scan(&cov.Encoding, &cov.Content); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &cov, nil
+}
+
+func (dbs *DBService) UpdateCover(cov *models.Cover) error {
+	query := `UPDATE covers SET encoding = $1, content = $2 WHERE id = $3;`
+	if _, err := dbs.db.Exec(query, cov.Encoding, cov.Content, cov.Id); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (dbs *DBService) CheckIfCoverExists(id int) (bool, error) {
+	query := `SELECT 1 FROM covers WHERE id = $1 LIMIT 1;`
+	return dbs.checkRow(query, id)
+}
+
+func (dbs *DBService) DeleteCover(id int) error {
+	query := `DELETE FROM covers WHERE id = $1;`
+	if _, err := dbs.db.Exec(query, id); err != nil {
+		return err
+	}
+	return nil
+}
+
+// --------------------------------------------------
+// > book
+// --------------------------------------------------
+
+// availableQuantityExpr is the on-hand quantity of a book minus the copies
+// held by active cart reservations. like the other book expressions, it
+// expects the books table to be unaliased.
+const availableQuantityExpr = `(books.quantity - COALESCE((
+            SELECT SUM(cart.quantity)
+            FROM cart
+            WHERE cart.book_id = books.id AND cart.reserved_until > (NOW() AT TIME ZONE 'UTC')
+        ), 0))`
+
+// discountedPriceExpr is the price a book is sold at, the same way cart computes it.
+const discountedPriceExpr = `(books.price - (books.discount * books.price))`
+
+// bookAuthorsExpr is the book's authors as a json array, in credit order.
+const bookAuthorsExpr = `COALESCE((
+            SELECT json_agg(json_build_object('id', authors.id, 'name', authors.name) ORDER BY book_authors.position)
+            FROM book_authors
+            JOIN authors ON authors.id = book_authors.author_id
+            WHERE book_authors.book_id = books.id
+        ), '[]')`
+
+// bookRatingExprs are the average rating, rounded to 2 decimals, and the
+// number of approved reviews of the book.
+const bookRatingExprs = `(
+            SELECT COALESCE(ROUND(AVG(reviews.rating), 2), 0)::float8
+            FROM reviews
+            WHERE reviews.book_id = books.id AND reviews.status = '` + models.ReviewStatusApproved + `'
+        ),
+        (
+            SELECT COUNT(*)
+            FROM reviews
+            WHERE reviews.book_id = books.id AND reviews.status = '` + models.ReviewStatusApproved + `'
+        )`
+
+// bookColumns are the books columns read by scanBook, in order.
+const bookColumns = `
+        books.id,
+        books.title,
+        books.description,
+        books.category_id,
+        COALESCE(books.cover_id, 0),
+        books.price,
+        books.quantity,
+        ` + availableQuantityExpr + `,
+        books.discount,
+        books.weight_grams,
+        books.isbn10,
+        books.isbn13,
+        books.added_at,
+        COALESCE(books.purchase_count, 0),
+        ` + bookRatingExprs + `,
+        ` + bookAuthorsExpr + `
     `
-	book := models.Book{Id: id}
-	if err := dbs.db.QueryRow(query, id).Scan(
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+// jsonColumn scans a json column into v.
+type jsonColumn struct {
+	v any
+}
+
+func (j jsonColumn) Scan(src any) error {
+	switch b := src.(type) {
+	case []byte:
+		return json.Unmarshal(b, j.v)
+	case string:
+		return json.Unmarshal([]byte(b), j.v)
+	default:
+		return fmt.Errorf("cannot scan %T into a json column", src)
+	}
+}
+
+// bookDest returns the scan destinations matching bookColumns.
+func bookDest(book *models.Book) []any {
+	return []any{
+		&book.Id,
 		&book.Title,
 		&book.Description,
 		&book.CategoryId,
 		&book.CoverId,
 		&book.Price,
 		&book.Quantity,
+		&book.AvailableQuantity,
 		&book.Discount,
+		&book.WeightGrams,
+		&book.Isbn10,
+		&book.Isbn13,
 		&book.AddedAt,
 		&book.PurchaseCount,
-	); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return nil, nil
-		}
-		return nil, err
+		&book.RatingAverage,
+		&book.RatingCount,
+		jsonColumn{&book.Authors},
 	}
-	return &book, nil
 }
 
-func (dbs *DBService) GetAllBooksByCategory(cid int) ([]*models.Book, error) {
-	query := `
-    SELECT
-        id,
-        title,
-        description,
-        cover_id,
-        price,
-        quantity,
-        discount,
-        added_at,
-        purchase_count
-    FROM books
-    WHERE category_id = $1; 
-    `
-	rows, err := dbs.db.Query(query, cid)
-	if err != nil {
+func scanBook(row scanner) (*models.Book, error) {
+	book := models.Book{}
+	if err := row.Scan(bookDest(&book)...); err != nil {
 		return nil, err
 	}
-	defer rows.Close()
+	return &book, nil
+}
 
+func scanBooks(rows *sql.Rows) ([]*models.Book, error) {
 	books := make([]*models.Book, 0)
 
 	for rows.Next() {
-		book := models.Book{CategoryId: cid}
-		if err := rows.Scan(
-			&book.Id,
-			&book.Title,
-			&book.Description,
-			&book.CoverId,
-			&book.Price,
-			&book.Quantity,
-			&book.Discount,
-			&book.AddedAt,
-			&book.PurchaseCount,
-		); err != nil {
+		book, err := scanBook(rows)
+		if err != nil {
 			return nil, err
 		}
-		books = append(books, &book)
+		books = append(books, book)
 	}
 	if err := rows.Err(); err != nil {
 		return nil, err
@@ -426,50 +911,16 @@ func (dbs *DBService) GetAllBooksByCategory(cid int) ([]*models.Book, error) {
 	return books, nil
 }
 
-func (dbs *DBService) UpdateBook(book *models.Book) error {
-	query := `
-    UPDATE books
-    SET 
-        title = $1,
-        description = $2,
-        category_id = $3,
-        price = $4,
-        quantity = $5,
-        discount = $6,
-    WHERE id = $7;
-    `
-	if _, err := dbs.db.Exec(
-		query,
-		book.Title,
-		book.Description,
-		book.CategoryId,
-		book.Price,
-		book.Quantity,
-		book.Discount,
-		book.Id,
-	); err != nil {
-		return err
-	}
-	return nil
-}
-
-func (dbs *DBService) CheckIfBookExists(id int) (bool, error) {
-	query := `SELECT 1 FROM books WHERE id = $1 LIMIT 1;`
-	return dbs.checkRow(query, id)
-}
-
-func (dbs *DBService) DeleteBook(id int) error {
-	query := `DELETE FROM books WHERE id = $1;`
-	if _, err := dbs.db.Exec(query, id); err != nil {
+// CreateBook inserts the book and links it to its authors.
+func (dbs *DBService) CreateBook(inout *models.Book) error {
+	tx, err := dbs.db.Begin()
+	if err != nil {
 		return err
 	}
-	return nil
-}
+	defer tx.Rollback()
 
-func (dbs *DBService) GetAllBooks(sorting string, page, limit int) ([]*models.Book, error) {
 	query := `
-    SELECT
-        id,
+    INSERT INTO books(
         title,
         description,
         category_id,
@@ -477,131 +928,1135 @@ func (dbs *DBService) GetAllBooks(sorting string, page, limit int) ([]*models.Bo
         price,
         quantity,
         discount,
-        added_at,
-        purchase_count
-    FROM books
+        weight_grams,
+        isbn10,
+        isbn13,
+        added_at
+    )
+    VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+    RETURNING id;
     `
-	var orderByClause string
-	switch sorting {
-	case "popularity":
-		orderByClause = "ORDER BY purchase_count DESC"
-	case "latest":
-		orderByClause = "ORDER BY added_at DESC"
-	case "price_desc":
-		orderByClause = "ORDER BY price DESC"
-	case "price_asc":
-		orderByClause = "ORDER BY price ASC"
-	default:
-		orderByClause = "ORDER BY added_at DESC"
+	if err := tx.QueryRow(
+		query,
+		inout.Title,
+		inout.Description,
+		inout.CategoryId,
+		inout.CoverId,
+		inout.Price,
+		inout.Quantity,
+		inout.Discount,
+		inout.WeightGrams,
+		inout.Isbn10,
+		inout.Isbn13,
+		inout.AddedAt,
+	).Scan(&inout.Id); err != nil {
+		if isUniqueViolation(err, "books_isbn13_idx") {
+			return ErrIsbnConflict
+		}
+		return err
 	}
 
-	query += orderByClause + " OFFSET $1 LIMIT $2"
+	if err := setBookAuthorsTx(tx, inout.Id, inout.Authors); err != nil {
+		return err
+	}
 
-	offset := (page - 1) * limit
+	return tx.Commit()
+}
 
-	rows, err := dbs.db.Query(query, offset, limit)
-	if err != nil {
-		return nil, err
+// setBookAuthorsTx replaces the book's authors, crediting them in order.
+func setBookAuthorsTx(tx *sql.Tx, bid int, authors []*models.BookAuthor) error {
+	query := `DELETE FROM book_authors WHERE book_id = $1;`
+	if _, err := tx.Exec(query, bid); err != nil {
+		return err
 	}
-	defer rows.Close()
-
-	books := make([]*models.Book, 0)
 
-	for rows.Next() {
-		book := models.Book{}
-		if err := rows.Scan(
-			&book.Id,
-			&book.Title,
-			&book.Description,
-			&book.CategoryId,
-			&book.CoverId,
-			&book.Price,
-			&book.Quantity,
-			&book.Discount,
-			&book.AddedAt,
-			&book.PurchaseCount,
-		); err != nil {
-			return nil, err
+	query = `INSERT INTO book_authors (book_id, author_id, position) VALUES ($1, $2, $3);`
+	for i, a := range authors {
+		if _, err := tx.Exec(query, bid, a.Id, i); err != nil {
+			return err
 		}
-		books = append(books, &book)
 	}
-	if err := rows.Err(); err != nil {
+	return nil
+}
+
+func (dbs *DBService) GetBookById(id int) (*models.Book, error) {
+	query := `SELECT ` + bookColumns + ` FROM books WHERE id = $1;`
+	book, err := scanBook(dbs.db.QueryRow(query, id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
 		return nil, err
 	}
-
-	return books, nil
+	return book, nil
 }
 
-func (dbs *DBService) GetTotalBooks() (int, error) {
-	query := `SELECT COUNT(*) FROM books;`
-	var count int
-	if err := dbs.db.QueryRow(query).Scan(&count); err != nil {
-		return 0, err
+// GetBookByIsbn finds a book by its normalized ISBN-13.
+func (dbs *DBService) GetBookByIsbn(isbn13 string) (*models.Book, error) {
+	query := `SELECT ` + bookColumns + ` FROM books WHERE isbn13 = $1;`
+	book, err := scanBook(dbs.db.QueryRow(query, isbn13))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
 	}
-	return count, nil
+	return book, nil
 }
 
-// --------------------------------------------------
-// > favourites
-// --------------------------------------------------
-func (dbs *DBService) AddBookToFavourites(uid, bid int) error {
-	query := `INSERT INTO favourites (user_id, book_id) VALUES ($1, $2);`
-	if _, err := dbs.db.Exec(query, uid, bid); err != nil {
+func (dbs *DBService) CheckIsbnConflict(isbn13 string) (bool, error) {
+	query := `SELECT 1 FROM books WHERE isbn13 = $1 LIMIT 1;`
+	return dbs.checkRow(query, isbn13)
+}
+
+// RefreshBookAffinities recomputes the co-purchase counts read by
+// GetRelatedBooks. books stay readable while it runs.
+func (dbs *DBService) RefreshBookAffinities() error {
+	query := `REFRESH MATERIALIZED VIEW CONCURRENTLY book_affinities;`
+	if _, err := dbs.db.Exec(query); err != nil {
 		return err
 	}
 	return nil
 }
 
-func (dbs *DBService) GetAllBooksInFavourites(uid int) ([]*models.Book, error) {
-	query := `SELECT book_id FROM favourites WHERE user_id = $1;`
-
-	rows, err := dbs.db.Query(query, uid)
+// GetRelatedBooks returns up to limit books most often bought together with
+// the book. when there aren't enough, the rest are the most popular books of
+// the same category.
+func (dbs *DBService) GetRelatedBooks(bid, limit int) ([]*models.Book, error) {
+	query := `
+    SELECT ` + bookColumns + `
+    FROM book_affinities
+    JOIN books ON books.id = book_affinities.related_book_id
+    WHERE book_affinities.book_id = $1
+    ORDER BY book_affinities.orders DESC, COALESCE(books.purchase_count, 0) DESC, books.id
+    LIMIT $2;
+    `
+	rows, err := dbs.db.Query(query, bid, limit)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
+	books, err := scanBooks(rows)
+	if err != nil {
+		return nil, err
+	}
+	rows.Close()
 
-	books := make([]*models.Book, 0)
+	if len(books) >= limit {
+		return books, nil
+	}
 
-	for rows.Next() {
-		book := models.Book{}
-		if err := rows.Scan(
-			&book.Id,
-			&book.Title,
-			&book.Description,
-			&book.CategoryId,
-			&book.CoverId,
-			&book.Price,
-			&book.Quantity,
-			&book.Discount,
-			&book.AddedAt,
-			&book.PurchaseCount,
-		); err != nil {
-			return nil, err
-		}
-		books = append(books, &book)
+	exclude := []int{bid}
+	for _, b := range books {
+		exclude = append(exclude, b.Id)
 	}
-	if err := rows.Err(); err != nil {
+	query = `
+    SELECT ` + bookColumns + `
+    FROM books
+    WHERE books.category_id = (SELECT category_id FROM books WHERE id = $1)
+        AND books.id <> ALL($2)
+    ORDER BY COALESCE(books.purchase_count, 0) DESC, books.id
+    LIMIT $3;
+    `
+	rows, err = dbs.db.Query(query, bid, pq.Array(exclude), limit-len(books))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	popular, err := scanBooks(rows)
+	if err != nil {
 		return nil, err
 	}
 
-	return books, nil
+	return append(books, popular...), nil
 }
 
-func (dbs *DBService) DeleteBookFromFavourites(uid, bid int) error {
-	query := `DELETE FROM favourites WHERE user_id = $1 AND book_id = $2;`
-	if _, err := dbs.db.Exec(query, uid, bid); err != nil {
-		return err
-	}
-	return nil
-}
+// weights of the signals blended by RefreshUserRecommendations
+const (
+	recommendationFavouriteWeight  = 3 // per favourite book in the category
+	recommendationPurchaseWeight   = 2 // per bought book in the category
+	recommendationCoPurchaseWeight = 2 // per order having the book with a seed book
+)
 
+// recommendationsPerUser is how many books RefreshUserRecommendations keeps
+// per user.
+const recommendationsPerUser = 50
+
+// purchasedBooksQuery lists the books each user bought in orders that weren't
+// cancelled.
+const purchasedBooksQuery = `
+    SELECT DISTINCT orders.user_id, order_book.book_id
+    FROM orders
+    JOIN order_book ON order_book.order_id = orders.id
+    WHERE orders.status <> '` + models.OrderStatusCancelled + `'
+    `
+
+// RefreshUserRecommendations recomputes the recommendations of every user
+// with favourites or orders. the user's favourite and bought books are seeds:
+// each gives its category a weight, and each book bought together with a seed
+// (see book_affinities) a weight per such order. a book scores its category's
+// weight plus its co-purchase weight. the seeds themselves and books out of
+// stock are left out, and ties go to the more popular book, then the lower id.
+func (dbs *DBService) RefreshUserRecommendations() error {
+	tx, err := dbs.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `DELETE FROM user_recommendations;`
+	if _, err := tx.Exec(query); err != nil {
+		return err
+	}
+
+	query = `
+    WITH purchased AS (` + purchasedBooksQuery + `),
+    seeds AS (
+        SELECT user_id, book_id, $1::float8 AS weight FROM purchased
+        UNION ALL
+        SELECT user_id, book_id, $2::float8 FROM favourites
+    ),
+    category_affinity AS (
+        SELECT seeds.user_id, books.category_id, SUM(seeds.weight) AS weight
+        FROM seeds
+        JOIN books ON books.id = seeds.book_id
+        GROUP BY seeds.user_id, books.category_id
+    ),
+    co_purchase AS (
+        SELECT seeds.user_id, book_affinities.related_book_id AS book_id, SUM(book_affinities.orders) AS orders
+        FROM seeds
+        JOIN book_affinities ON book_affinities.book_id = seeds.book_id
+        GROUP BY seeds.user_id, book_affinities.related_book_id
+    ),
+    candidates AS (
+        SELECT category_affinity.user_id, books.id AS book_id
+        FROM category_affinity
+        JOIN books ON books.category_id = category_affinity.category_id
+        UNION
+        SELECT user_id, book_id FROM co_purchase
+    ),
+    ranked AS (
+        SELECT
+            candidates.user_id,
+            candidates.book_id,
+            COALESCE(category_affinity.weight, 0) + $3 * COALESCE(co_purchase.orders, 0) AS score,
+            ROW_NUMBER() OVER (
+                PARTITION BY candidates.user_id
+                ORDER BY
+                    COALESCE(category_affinity.weight, 0) + $3 * COALESCE(co_purchase.orders, 0) DESC,
+                    COALESCE(books.purchase_count, 0) DESC,
+                    books.id
+            ) AS rank
+        FROM candidates
+        JOIN books ON books.id = candidates.book_id
+        LEFT JOIN category_affinity ON category_affinity.user_id = candidates.user_id
+            AND category_affinity.category_id = books.category_id
+        LEFT JOIN co_purchase ON co_purchase.user_id = candidates.user_id
+            AND co_purchase.book_id = candidates.book_id
+        WHERE ` + availableQuantityExpr + ` > 0
+            AND NOT EXISTS (
+                SELECT 1 FROM seeds
+                WHERE seeds.user_id = candidates.user_id AND seeds.book_id = candidates.book_id
+            )
+    )
+    INSERT INTO user_recommendations (user_id, book_id, score, rank, computed_at)
+    SELECT user_id, book_id, score, rank, $4
+    FROM ranked
+    WHERE rank <= $5;
+    `
+	if _, err := tx.Exec(
+		query,
+		recommendationPurchaseWeight,
+		recommendationFavouriteWeight,
+		recommendationCoPurchaseWeight,
+		time.Now().UTC(),
+		recommendationsPerUser,
+	); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetUserRecommendations returns up to limit of the user's recommended books,
+// best first, leaving out those bought, favourited or sold out since they were
+// computed. users without recommendations get the most popular books they
+// haven't bought or favourited.
+func (dbs *DBService) GetUserRecommendations(uid, limit int) ([]*models.Book, error) {
+	query := `
+    SELECT ` + bookColumns + `
+    FROM user_recommendations
+    JOIN books ON books.id = user_recommendations.book_id
+    WHERE user_recommendations.user_id = $1
+        AND ` + availableQuantityExpr + ` > 0
+        AND books.id NOT IN (SELECT book_id FROM (` + purchasedBooksQuery + `) purchased WHERE user_id = $1)
+        AND books.id NOT IN (SELECT book_id FROM favourites WHERE user_id = $1)
+    ORDER BY user_recommendations.rank
+    LIMIT $2;
+    `
+	rows, err := dbs.db.Query(query, uid, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	books, err := scanBooks(rows)
+	if err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	if len(books) > 0 {
+		return books, nil
+	}
+
+	query = `
+    SELECT ` + bookColumns + `
+    FROM books
+    WHERE ` + availableQuantityExpr + ` > 0
+        AND books.id NOT IN (SELECT book_id FROM (` + purchasedBooksQuery + `) purchased WHERE user_id = $1)
+        AND books.id NOT IN (SELECT book_id FROM favourites WHERE user_id = $1)
+    ORDER BY COALESCE(books.purchase_count, 0) DESC, books.id
+    LIMIT $2;
+    `
+	rows, err = dbs.db.Query(query, uid, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanBooks(rows)
+}
+
+// GetExistingIsbns returns which of the ISBN-13s already belong to a book.
+func (dbs *DBService) GetExistingIsbns(isbns []string) (map[string]bool, error) {
+	query := `SELECT isbn13 FROM books WHERE isbn13 = ANY($1);`
+	rows, err := dbs.db.Query(query, pq.Array(isbns))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	existing := make(map[string]bool)
+
+	for rows.Next() {
+		var isbn string
+		if err := rows.Scan(&isbn); err != nil {
+			return nil, err
+		}
+		existing[isbn] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return existing, nil
+}
+
+// importBatchSize is how many books ImportBooks inserts per statement.
+const importBatchSize = 100
+
+// ImportBooks inserts the books in one transaction. covers[i], when not nil,
+// is created first as the cover of books[i].
+func (dbs *DBService) ImportBooks(books []*models.Book, covers []*models.Cover) error {
+	tx, err := dbs.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `INSERT INTO covers (encoding, content) VALUES ($1, $2) RETURNING id;`
+	for i, cov := range covers {
+		if cov == nil {
+			continue
+		}
+		if err := tx.QueryRow(query, cov.Encoding, cov.Content).Scan(&cov.Id); err != nil {
+			return err
+		}
+		books[i].CoverId = cov.Id
+	}
+
+	for start := 0; start < len(books); start += importBatchSize {
+		batch := books[start:min(start+importBatchSize, len(books))]
+		values := make([]string, 0, len(batch))
+		args := make([]any, 0, len(batch)*11)
+		for _, b := range batch {
+			n := len(args)
+			values = append(values, fmt.Sprintf(
+				"($%d, $%d, $%d, NULLIF($%d, 0), $%d, $%d, $%d, $%d, $%d, $%d, $%d)",
+				n+1, n+2, n+3, n+4, n+5, n+6, n+7, n+8, n+9, n+10, n+11,
+			))
+			args = append(args,
+				b.Title,
+				b.Description,
+				b.CategoryId,
+				b.CoverId,
+				b.Price,
+				b.Quantity,
+				b.Discount,
+				b.WeightGrams,
+				b.Isbn10,
+				b.Isbn13,
+				b.AddedAt,
+			)
+		}
+		query := `
+        INSERT INTO books(
+            title,
+            description,
+            category_id,
+            cover_id,
+            price,
+            quantity,
+            discount,
+            weight_grams,
+            isbn10,
+            isbn13,
+            added_at
+        )
+        VALUES ` + strings.Join(values, ", ") + `;`
+		if _, err := tx.Exec(query, args...); err != nil {
+			if isUniqueViolation(err, "books_isbn13_idx") {
+				return ErrIsbnConflict
+			}
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// UpdateBook updates the book and replaces its authors.
+func (dbs *DBService) UpdateBook(book *models.Book) error {
+	tx, err := dbs.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+    UPDATE books
+    SET 
+        title = $1,
+        description = $2,
+        category_id = $3,
+        price = $4,
+        quantity = $5,
+        discount = $6,
+        weight_grams = $7,
+        isbn10 = $8,
+        isbn13 = $9
+    WHERE id = $10;
+    `
+	if _, err := tx.Exec(
+		query,
+		book.Title,
+		book.Description,
+		book.CategoryId,
+		book.Price,
+		book.Quantity,
+		book.Discount,
+		book.WeightGrams,
+		book.Isbn10,
+		book.Isbn13,
+		book.Id,
+	); err != nil {
+		if isUniqueViolation(err, "books_isbn13_idx") {
+			return ErrIsbnConflict
+		}
+		return err
+	}
+
+	if err := setBookAuthorsTx(tx, book.Id, book.Authors); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (dbs *DBService) CheckIfBookExists(id int) (bool, error) {
+	query := `SELECT 1 FROM books WHERE id = $1 LIMIT 1;`
+	return dbs.checkRow(query, id)
+}
+
+func (dbs *DBService) DeleteBook(id int) error {
+	query := `DELETE FROM books WHERE id = $1;`
+	if _, err := dbs.db.Exec(query, id); err != nil {
+		return err
+	}
+	return nil
+}
+
+// bookFilterClause builds the WHERE clause for the filter. its placeholders
+// are numbered after the len(args) arguments the query already has, and
+// the returned args include them.
+func bookFilterClause(f *models.BookFilter, args []any) (string, []any) {
+	conds := make([]string, 0)
+	arg := func(v any) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if f.Query != "" {
+		conds = append(conds, "books.search_vector @@ websearch_to_tsquery('english', "+arg(f.Query)+")")
+	}
+	if len(f.CategoryIds) > 0 {
+		conds = append(conds, "books.category_id = ANY("+arg(pq.Array(f.CategoryIds))+")")
+	}
+	if len(f.ScopeCategoryIds) > 0 {
+		conds = append(conds, "books.category_id = ANY("+arg(pq.Array(f.ScopeCategoryIds))+")")
+	}
+	if len(f.AuthorIds) > 0 {
+		conds = append(conds, `EXISTS (
+            SELECT 1 FROM book_authors
+            WHERE book_authors.book_id = books.id AND book_authors.author_id = ANY(`+arg(pq.Array(f.AuthorIds))+`)
+        )`)
+	}
+	if f.MinPrice != nil {
+		conds = append(conds, discountedPriceExpr+" >= "+arg(*f.MinPrice))
+	}
+	if f.MaxPrice != nil {
+		conds = append(conds, discountedPriceExpr+" <= "+arg(*f.MaxPrice))
+	}
+	if f.InStock {
+		conds = append(conds, availableQuantityExpr+" > 0")
+	}
+	if f.Discounted {
+		conds = append(conds, "books.discount > 0")
+	}
+	if f.AddedAfter != nil {
+		conds = append(conds, "books.added_at > "+arg(*f.AddedAfter))
+	}
+
+	if len(conds) == 0 {
+		return "", args
+	}
+	return " WHERE " + strings.Join(conds, " AND ") + " ", args
+}
+
+// bookSortKeys are the ORDER BY keys of each book sorting. ties are broken by
+// id in the same direction, so the order is total and keyset pages don't skip
+// or repeat books.
+var bookSortKeys = map[string]struct {
+	expr string
+	desc bool
+}{
+	"popularity": {"COALESCE(books.purchase_count, 0)", true},
+	"latest":     {"books.added_at", true},
+	"price_desc": {discountedPriceExpr, true},
+	"price_asc":  {discountedPriceExpr, false},
+}
+
+// bookCursorValue appends the cursor's value for the sorting's key to args,
+// and returns the sql expression reading it.
+func bookCursorValue(sorting string, cursor *models.BookCursor, args []any) (string, []any) {
+	switch sorting {
+	case "popularity":
+		args = append(args, cursor.PurchaseCount)
+	case "price_desc", "price_asc":
+		// computed in numeric like discountedPriceExpr, so it equals the
+		// key of the cursor's book exactly
+		args = append(args, cursor.Price, cursor.Discount)
+		return fmt.Sprintf("($%d::numeric - ($%d::numeric * $%d::numeric))", len(args)-1, len(args), len(args)-1), args
+	default:
+		args = append(args, cursor.AddedAt)
+	}
+	return fmt.Sprintf("$%d", len(args)), args
+}
+
+// GetAllBooks lists a page of the books matching the filter. with a cursor
+// the page starts right after the cursor's book and page is ignored.
+func (dbs *DBService) GetAllBooks(filter *models.BookFilter, sorting string, after *models.BookCursor, page, limit int) ([]*models.Book, error) {
+	key, ok := bookSortKeys[sorting]
+	if !ok {
+		sorting = "latest"
+		key = bookSortKeys[sorting]
+	}
+	dir, cmp := "ASC", ">"
+	if key.desc {
+		dir, cmp = "DESC", "<"
+	}
+
+	where, args := bookFilterClause(filter, nil)
+	offset := (page - 1) * limit
+	if after != nil {
+		var value string
+		value, args = bookCursorValue(sorting, after, args)
+		args = append(args, after.Id)
+		cond := fmt.Sprintf("(%s, books.id) %s (%s, $%d)", key.expr, cmp, value, len(args))
+		if where == "" {
+			where = " WHERE " + cond + " "
+		} else {
+			where += "AND " + cond + " "
+		}
+		offset = 0
+	}
+
+	args = append(args, offset, limit)
+	query := `SELECT ` + bookColumns + ` FROM books ` + where +
+		fmt.Sprintf("ORDER BY %s %s, books.id %s OFFSET $%d LIMIT $%d", key.expr, dir, dir, len(args)-1, len(args))
+
+	rows, err := dbs.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanBooks(rows)
+}
+
+func (dbs *DBService) GetTotalBooks(filter *models.BookFilter) (int, error) {
+	where, args := bookFilterClause(filter, nil)
+	query := `SELECT COUNT(*) FROM books ` + where
+	var count int
+	if err := dbs.db.QueryRow(query, args...).Scan(&count); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// htmlEscapeExpr escapes the html special characters of a text column, so
+// the highlights built from it hold no markup but the <mark> tags.
+func htmlEscapeExpr(col string) string {
+	return `replace(replace(replace(replace(replace(` + col + `,
+        '&', '&amp;'), '<', '&lt;'), '>', '&gt;'), '"', '&quot;'), '''', '&#39;')`
+}
+
+// SearchBooks ranks books matching the filter's web-search style query
+// (quoted phrases, "or", -exclusions) by relevance, title matches first.
+// matched words in the title and a description snippet are wrapped in <mark>
+// tags, and the rest of their text is html escaped. the rest of the filter
+// applies as in GetAllBooks, and GetTotalBooks counts the results.
+func (dbs *DBService) SearchBooks(filter *models.BookFilter, page, limit int) ([]*models.BookSearchResult, error) {
+	where, args := bookFilterClause(filter, []any{filter.Query})
+	offset := (page - 1) * limit
+	args = append(args, offset, limit)
+	query := `
+    SELECT ` + bookColumns + `,
+        ts_rank(books.search_vector, query),
+        ts_headline('english', ` + htmlEscapeExpr("books.title") + `, query, 'StartSel=<mark>, StopSel=</mark>, HighlightAll=true'),
+        ts_headline('english', ` + htmlEscapeExpr("books.description") + `, query, 'StartSel=<mark>, StopSel=</mark>, MaxFragments=2, MaxWords=30, MinWords=10')
+    FROM books, websearch_to_tsquery('english', $1) query
+    ` + where + `
+    ORDER BY ts_rank(books.search_vector, query) DESC, books.id
+    ` + fmt.Sprintf("OFFSET $%d LIMIT $%d", len(args)-1, len(args))
+
+	rows, err := dbs.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := make([]*models.BookSearchResult, 0)
+
+	for rows.Next() {
+		res := models.BookSearchResult{}
+		dest := append(bookDest(&res.Book), &res.Rank, &res.Highlights.Title, &res.Highlights.Description)
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		results = append(results, &res)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// priceBucketBounds split the discounted price into the buckets counted by
+// GetBookFacets: [0, 10), [10, 20), [20, 50), [50, 100), [100, ...).
+var priceBucketBounds = []float64{10, 20, 50, 100}
+
+// GetBookFacets counts the books matching the filter per category, price
+// bucket and availability. each facet ignores its own part of the filter, so
+// it shows what picking another value would match.
+func (dbs *DBService) GetBookFacets(filter *models.BookFilter) (*models.BookFacets, error) {
+	facets := models.BookFacets{}
+
+	// categories
+	f := *filter
+	f.CategoryIds = nil
+	where, args := bookFilterClause(&f, nil)
+	query := `
+    SELECT categories.id, categories.name, COUNT(*)
+    FROM books
+    JOIN categories ON categories.id = books.category_id
+    ` + where + `
+    GROUP BY categories.id, categories.name
+    ORDER BY COUNT(*) DESC, categories.name;
+    `
+	rows, err := dbs.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	facets.Categories = make([]*models.CategoryFacet, 0)
+	for rows.Next() {
+		cf := models.CategoryFacet{}
+		if err := rows.Scan(&cf.Id, &cf.Name, &cf.Count); err != nil {
+			return nil, err
+		}
+		facets.Categories = append(facets.Categories, &cf)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	// price buckets
+	f = *filter
+	f.MinPrice, f.MaxPrice = nil, nil
+	where, args = bookFilterClause(&f, []any{pq.Array(priceBucketBounds)})
+	query = `
+    SELECT width_bucket(` + discountedPriceExpr + `::float8, $1::float8[]), COUNT(*)
+    FROM books
+    ` + where + `
+    GROUP BY 1;
+    `
+	rows, err = dbs.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := make(map[int]int)
+	for rows.Next() {
+		var bucket, count int
+		if err := rows.Scan(&bucket, &count); err != nil {
+			return nil, err
+		}
+		counts[bucket] = count
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+	facets.PriceBuckets = make([]*models.PriceBucketFacet, 0, len(priceBucketBounds)+1)
+	for i := 0; i <= len(priceBucketBounds); i++ {
+		pb := models.PriceBucketFacet{Count: counts[i]}
+		if i > 0 {
+			pb.Min = priceBucketBounds[i-1]
+		}
+		if i < len(priceBucketBounds) {
+			max := priceBucketBounds[i]
+			pb.Max = &max
+		}
+		facets.PriceBuckets = append(facets.PriceBuckets, &pb)
+	}
+
+	// availability
+	f = *filter
+	f.InStock = false
+	where, args = bookFilterClause(&f, nil)
+	query = `
+    SELECT
+        COUNT(*) FILTER (WHERE ` + availableQuantityExpr + ` > 0),
+        COUNT(*) FILTER (WHERE ` + availableQuantityExpr + ` <= 0)
+    FROM books
+    ` + where
+	if err := dbs.db.QueryRow(query, args...).Scan(
+		&facets.Availability.InStock,
+		&facets.Availability.OutOfStock,
+	); err != nil {
+		return nil, err
+	}
+
+	return &facets, nil
+}
+
+// --------------------------------------------------
+// > favourites
 // --------------------------------------------------
-// > cart
-// --------------------------------------------------
-func (dbs *DBService) AddBookToCart(uid, bid, quantity int) error {
+func (dbs *DBService) AddBookToFavourites(uid, bid int) error {
+	query := `INSERT INTO favourites (user_id, book_id) VALUES ($1, $2);`
+	if _, err := dbs.db.Exec(query, uid, bid); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (dbs *DBService) GetAllBooksInFavourites(uid int) ([]*models.Book, error) {
+	query := `
+    SELECT ` + bookColumns + `
+    FROM books
+    JOIN favourites ON favourites.book_id = books.id
+    WHERE favourites.user_id = $1;
+    `
+	rows, err := dbs.db.Query(query, uid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanBooks(rows)
+}
+
+func (dbs *DBService) DeleteBookFromFavourites(uid, bid int) error {
+	query := `DELETE FROM favourites WHERE user_id = $1 AND book_id = $2;`
+	if _, err := dbs.db.Exec(query, uid, bid); err != nil {
+		return err
+	}
+	return nil
+}
+
+// --------------------------------------------------
+// > review
+// --------------------------------------------------
+
+// reviewColumns are the reviews columns read by scanReview, in order. the
+// query must join users.
+const reviewColumns = `
+        reviews.id,
+        reviews.user_id,
+        users.username,
+        reviews.book_id,
+        reviews.rating,
+        reviews.text,
+        EXISTS (
+            SELECT 1
+            FROM order_book
+            JOIN orders ON orders.id = order_book.order_id
+            WHERE orders.user_id = reviews.user_id
+                AND order_book.book_id = reviews.book_id
+                AND orders.status = '` + models.OrderStatusDelivered + `'
+        ),
+        reviews.status,
+        reviews.created_at,
+        reviews.updated_at
+    `
+
+func scanReview(row scanner) (*models.Review, error) {
+	review := models.Review{}
+	if err := row.Scan(
+		&review.Id,
+		&review.UserId,
+		&review.Username,
+		&review.BookId,
+		&review.Rating,
+		&review.Text,
+		&review.VerifiedPurchase,
+		&review.Status,
+		&review.CreatedAt,
+		&review.UpdatedAt,
+	); err != nil {
+		return nil, err
+	}
+	return &review, nil
+}
+
+func (dbs *DBService) CheckIfReviewExists(uid, bid int) (bool, error) {
+	query := `SELECT 1 FROM reviews WHERE user_id = $1 AND book_id = $2 LIMIT 1;`
+	return dbs.checkRow(query, uid, bid)
+}
+
+// CreateReview inserts the review along with the listed words found in it.
+func (dbs *DBService) CreateReview(inout *models.Review, flaggedWords []string) error {
 	query := `
-    INSERT INTO cart (user_id, book_id, quantity, price_per_unite)
+    INSERT INTO reviews (user_id, book_id, rating, text, status, flagged_words, created_at, updated_at)
+    VALUES ($1, $2, $3, $4, $5, $6, $7, $7)
+    RETURNING id;
+    `
+	if err := dbs.db.QueryRow(
+		query,
+		inout.UserId,
+		inout.BookId,
+		inout.Rating,
+		inout.Text,
+		inout.Status,
+		pq.Array(flaggedWords),
+		inout.CreatedAt,
+	).Scan(&inout.Id); err != nil {
+		if isUniqueViolation(err, "reviews_user_id_book_id_key") {
+			return ErrReviewExists
+		}
+		return err
+	}
+	return nil
+}
+
+// GetReview returns the user's review of the book.
+func (dbs *DBService) GetReview(uid, bid int) (*models.Review, error) {
+	query := `
+    SELECT ` + reviewColumns + `
+    FROM reviews
+    JOIN users ON users.id = reviews.user_id
+    WHERE reviews.user_id = $1 AND reviews.book_id = $2;
+    `
+	review, err := scanReview(dbs.db.QueryRow(query, uid, bid))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return review, nil
+}
+
+// GetAllReviewsByBook lists a page of the book's approved reviews, newest first.
+func (dbs *DBService) GetAllReviewsByBook(bid, page, limit int) ([]*models.Review, error) {
+	query := `
+    SELECT ` + reviewColumns + `
+    FROM reviews
+    JOIN users ON users.id = reviews.user_id
+    WHERE reviews.book_id = $1 AND reviews.status = '` + models.ReviewStatusApproved + `'
+    ORDER BY reviews.created_at DESC, reviews.id DESC
+    OFFSET $2 LIMIT $3;
+    `
+	offset := (page - 1) * limit
+	rows, err := dbs.db.Query(query, bid, offset, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reviews := make([]*models.Review, 0)
+
+	for rows.Next() {
+		review, err := scanReview(rows)
+		if err != nil {
+			return nil, err
+		}
+		reviews = append(reviews, review)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return reviews, nil
+}
+
+func (dbs *DBService) GetTotalReviewsByBook(bid int) (int, error) {
+	query := `SELECT COUNT(*) FROM reviews WHERE book_id = $1 AND status = '` + models.ReviewStatusApproved + `';`
+	var count int
+	if err := dbs.db.QueryRow(query, bid).Scan(&count); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// UpdateReview updates the review's content and status, along with the
+// listed words found in it.
+func (dbs *DBService) UpdateReview(review *models.Review, flaggedWords []string) error {
+	query := `
+    UPDATE reviews
+    SET
+        rating = $1,
+        text = $2,
+        status = $3,
+        flagged_words = $4,
+        updated_at = $5
+    WHERE id = $6;
+    `
+	if _, err := dbs.db.Exec(
+		query,
+		review.Rating,
+		review.Text,
+		review.Status,
+		pq.Array(flaggedWords),
+		review.UpdatedAt,
+		review.Id,
+	); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (dbs *DBService) DeleteReview(uid, bid int) error {
+	query := `DELETE FROM reviews WHERE user_id = $1 AND book_id = $2;`
+	if _, err := dbs.db.Exec(query, uid, bid); err != nil {
+		return err
+	}
+	return nil
+}
+
+// moderatedReviewColumns are the columns read by scanModeratedReview, in
+// order. the query must join users.
+const moderatedReviewColumns = reviewColumns + `,
+        reviews.flagged_words,
+        (
+            SELECT COUNT(*)
+            FROM review_reports
+            WHERE review_reports.review_id = reviews.id
+                AND review_reports.created_at > COALESCE(reviews.moderated_at, '-infinity')
+        ) AS open_reports,
+        reviews.moderated_by,
+        reviews.moderated_at
+    `
+
+func scanModeratedReview(row scanner) (*models.ModeratedReview, error) {
+	review := models.ModeratedReview{}
+	if err := row.Scan(
+		&review.Id,
+		&review.UserId,
+		&review.Username,
+		&review.BookId,
+		&review.Rating,
+		&review.Text,
+		&review.VerifiedPurchase,
+		&review.Status,
+		&review.CreatedAt,
+		&review.UpdatedAt,
+		pq.Array(&review.FlaggedWords),
+		&review.OpenReports,
+		&review.ModeratedBy,
+		&review.ModeratedAt,
+	); err != nil {
+		return nil, err
+	}
+	return &review, nil
+}
+
+// moderationQueueClause builds the WHERE clause of the moderation queue.
+// reportedOnly keeps the reviews with open reports.
+func moderationQueueClause(status string, reportedOnly bool) (string, []any) {
+	where := `WHERE reviews.status = $1`
+	if reportedOnly {
+		where += ` AND EXISTS (
+            SELECT 1
+            FROM review_reports
+            WHERE review_reports.review_id = reviews.id
+                AND review_reports.created_at > COALESCE(reviews.moderated_at, '-infinity')
+        )`
+	}
+	return where, []any{status}
+}
+
+// GetModerationQueue lists a page of the reviews with the status. flagged
+// reviews come first, then the most reported, then the oldest.
+func (dbs *DBService) GetModerationQueue(status string, reportedOnly bool, page, limit int) ([]*models.ModeratedReview, error) {
+	where, args := moderationQueueClause(status, reportedOnly)
+	args = append(args, (page-1)*limit, limit)
+	query := `
+    SELECT ` + moderatedReviewColumns + `
+    FROM reviews
+    JOIN users ON users.id = reviews.user_id
+    ` + where + `
+    ORDER BY cardinality(reviews.flagged_words) > 0 DESC, open_reports DESC, reviews.created_at, reviews.id
+    OFFSET $2 LIMIT $3;
+    `
+	rows, err := dbs.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reviews := make([]*models.ModeratedReview, 0)
+
+	for rows.Next() {
+		review, err := scanModeratedReview(rows)
+		if err != nil {
+			return nil, err
+		}
+		reviews = append(reviews, review)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return reviews, nil
+}
+
+func (dbs *DBService) GetTotalModerationQueue(status string, reportedOnly bool) (int, error) {
+	where, args := moderationQueueClause(status, reportedOnly)
+	query := `SELECT COUNT(*) FROM reviews ` + where
+	var count int
+	if err := dbs.db.QueryRow(query, args...).Scan(&count); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func (dbs *DBService) GetReviewById(id int) (*models.Review, error) {
+	query := `
+    SELECT ` + reviewColumns + `
+    FROM reviews
+    JOIN users ON users.id = reviews.user_id
+    WHERE reviews.id = $1;
+    `
+	review, err := scanReview(dbs.db.QueryRow(query, id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return review, nil
+}
+
+// ModerateReview sets the review's status, recording who moderated it and
+// when. reports made before then are no longer open. seenUpdatedAt is the
+// review's updatedAt as the moderator saw it; if the review was edited since,
+// nothing changes and ErrReviewChanged is returned.
+func (dbs *DBService) ModerateReview(id int, status string, seenUpdatedAt time.Time, actorId int, at time.Time) error {
+	query := `
+    UPDATE reviews
+    SET status = $1, moderated_by = NULLIF($2, 0), moderated_at = $3
+    WHERE id = $4 AND updated_at = $5;
+    `
+	res, err := dbs.db.Exec(query, status, actorId, at, id, seenUpdatedAt.UTC())
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrReviewChanged
+	}
+	return nil
+}
+
+func (dbs *DBService) CheckIfReviewReported(id, uid int) (bool, error) {
+	query := `SELECT 1 FROM review_reports WHERE review_id = $1 AND user_id = $2 LIMIT 1;`
+	return dbs.checkRow(query, id, uid)
+}
+
+func (dbs *DBService) CreateReviewReport(id, uid int, reason string, at time.Time) error {
+	query := `INSERT INTO review_reports (review_id, user_id, reason, created_at) VALUES ($1, $2, $3, $4);`
+	if _, err := dbs.db.Exec(query, id, uid, reason, at); err != nil {
+		if isUniqueViolation(err, "review_reports_review_id_user_id_key") {
+			return ErrReviewReported
+		}
+		return err
+	}
+	return nil
+}
+
+// --------------------------------------------------
+// > cart
+// --------------------------------------------------
+// AddBookToCart reserves quantity more copies of the book in the user's cart
+// until reservedUntil. stock isn't taken until checkout, but copies reserved
+// in other active carts can't be reserved again. the book row is locked so
+// concurrent shoppers can't over-reserve it.
+func (dbs *DBService) AddBookToCart(uid, bid, quantity int, reservedUntil time.Time) error {
+	tx, err := dbs.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `SELECT quantity FROM books WHERE id = $1 FOR UPDATE;`
+	var stock int
+	if err := tx.QueryRow(query, bid).Scan(&stock); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrBookNotFound
+		}
+		return err
+	}
+
+	query = `
+    SELECT
+        COALESCE(SUM(quantity) FILTER (WHERE user_id <> $2 AND reserved_until > $3), 0),
+        COALESCE(SUM(quantity) FILTER (WHERE user_id = $2), 0)
+    FROM cart
+    WHERE book_id = $1;
+    `
+	var reservedByOthers, inCart int
+	if err := tx.QueryRow(query, bid, uid, time.Now().UTC()).Scan(&reservedByOthers, &inCart); err != nil {
+		return err
+	}
+	if stock-reservedByOthers < inCart+quantity {
+		return ErrInsufficientStock
+	}
+
+	query = `
+    INSERT INTO cart (user_id, book_id, quantity, price_per_unite, reserved_until)
     VALUES (
         $1,
         $2,
@@ -609,283 +2064,980 @@ func (dbs *DBService) AddBookToCart(uid, bid, quantity int) error {
         (SELECT 
             price - (discount * price)
         FROM books
-        WHERE id = $2)
-    );
+        WHERE id = $2),
+        $4
+    )
+    ON CONFLICT (user_id, book_id) DO UPDATE
+    SET quantity = cart.quantity + EXCLUDED.quantity,
+        reserved_until = EXCLUDED.reserved_until;
+    `
+	if _, err := tx.Exec(query, uid, bid, quantity, reservedUntil); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (dbs *DBService) GetBookFromCart(uid, bid int) (*models.CartBook, error) {
+	query := `
+    SELECT quantity, price_per_unite, reserved_until
+    FROM cart
+    WHERE user_id = $1 AND book_id = $2;
     `
-	if _, err := dbs.db.Exec(query, uid, bid, quantity); err != nil {
+	cb := models.CartBook{UserId: uid, BookId: bid}
+	if err := dbs.db.QueryRow(query, uid, bid).Scan(&cb.Quantity, &cb.PricePerUnite, &cb.ReservedUntil); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &cb, nil
+}
+
+func (dbs *DBService) GetBooksInCart(uid int) ([]*models.CartBook, error) {
+	query := `SELECT book_id, quantity, price_per_unite, reserved_until FROM cart WHERE user_id = $1;`
+
+	rows, err := dbs.db.Query(query, uid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	books := make([]*models.CartBook, 0)
+
+	for rows.Next() {
+		book := models.CartBook{UserId: uid}
+		if err := rows.Scan(
+			&book.BookId,
+			&book.Quantity,
+			&book.PricePerUnite,
+			&book.ReservedUntil,
+		); err != nil {
+			return nil, err
+		}
+		books = append(books, &book)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return books, nil
+}
+
+func (dbs *DBService) DeleteBookFromCart(uid, bid int) error {
+	query := `DELETE FROM cart WHERE user_id = $1 AND book_id = $2;`
+	res, err := dbs.db.Exec(query, uid, bid)
+	if err != nil {
 		return err
 	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrBookNotInCart
+	}
 	return nil
 }
 
-func (dbs *DBService) GetBookFromCart(uid, bid int) (*models.CartBook, error) {
-	query := `SELECT quantity, price_per_unite FROM cart WHERE uid = $1 AND bid = $2;`
-	cb := models.CartBook{UserId: uid, BookId: bid}
-	if err := dbs.db.QueryRow(query, uid, bid).Scan(&cb.Quantity, &cb.PricePerUnite); err != nil {
+// ReleaseExpiredReservations drops cart lines whose reservation has expired
+// and returns how many were dropped.
+func (dbs *DBService) ReleaseExpiredReservations() (int64, error) {
+	query := `DELETE FROM cart WHERE reserved_until <= $1;`
+	res, err := dbs.db.Exec(query, time.Now().UTC())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// --------------------------------------------------
+// > order
+// --------------------------------------------------
+
+// MakeOrder turns the user's cart into an order, taking the books from stock,
+// and returns its id. the shipping cost is added to the order total; it was
+// quoted for quotedWeight grams, and if the locked cart weighs anything else
+// ErrCartChanged is returned. the books in the cart are locked in id order,
+// then the cart rows of those books, so checkout can't interleave with cart
+// changes or other checkouts touching the same books. only the locked lines
+// are ordered; lines added to the cart meanwhile are left in it.
+func (dbs *DBService) MakeOrder(uid, quotedWeight int, shippingService string, shippingCost float64) (int, error) {
+	tx, err := dbs.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	query := `
+    SELECT b.id
+    FROM books b
+    JOIN cart c ON c.book_id = b.id
+    WHERE c.user_id = $1
+    ORDER BY b.id
+    FOR UPDATE OF b;
+    `
+	rows, err := tx.Query(query, uid)
+	if err != nil {
+		return 0, err
+	}
+	locked := make([]int, 0)
+	for rows.Next() {
+		var bid int
+		if err := rows.Scan(&bid); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		locked = append(locked, bid)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	// get cart items
+	query = `
+    SELECT c.book_id, c.quantity, c.price_per_unite, b.weight_grams
+    FROM cart c
+    JOIN books b ON b.id = c.book_id
+    WHERE c.user_id = $1 AND c.book_id = ANY($2)
+    FOR UPDATE OF c;
+    `
+	rows, err = tx.Query(query, uid, pq.Array(locked))
+	if err != nil {
+		return 0, err
+	}
+	books := make([]*models.CartBook, 0)
+	bids := make([]int, 0)
+	weight := 0
+	for rows.Next() {
+		book := models.CartBook{UserId: uid}
+		var weightGrams int
+		if err := rows.Scan(&book.BookId, &book.Quantity, &book.PricePerUnite, &weightGrams); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		books = append(books, &book)
+		bids = append(bids, book.BookId)
+		weight += weightGrams * book.Quantity
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(books) == 0 {
+		return 0, ErrEmptyCart
+	}
+	if weight != quotedWeight {
+		return 0, ErrCartChanged
+	}
+
+	// a line whose reservation expired can still be bought, as long as the
+	// copies weren't reserved by someone else in the meantime.
+	query = `
+    SELECT c.book_id
+    FROM cart c
+    JOIN books b ON b.id = c.book_id
+    WHERE c.user_id = $1 AND c.book_id = ANY($3)
+        AND b.quantity - COALESCE((
+            SELECT SUM(o.quantity)
+            FROM cart o
+            WHERE o.book_id = c.book_id AND o.user_id <> $1 AND o.reserved_until > $2
+        ), 0) < c.quantity
+    LIMIT 1;
+    `
+	var bid int
+	if err := tx.QueryRow(query, uid, time.Now().UTC(), pq.Array(bids)).Scan(&bid); err == nil {
+		return 0, fmt.Errorf("%w for book with id %d", ErrInsufficientStock, bid)
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return 0, err
+	}
+
+	// count total price
+	totalPrice := shippingCost
+	for _, book := range books {
+		totalPrice += float64(book.Quantity) * book.PricePerUnite
+	}
+
+	// insert new order
+	query = `
+    INSERT INTO orders (user_id, applied_at, total_price, shipping_service, shipping_cost, status)
+    VALUES ($1, $2, $3, $4, $5, $6)
+    RETURNING id;
+    `
+	now := time.Now().UTC()
+	var orderId int
+	if err := tx.QueryRow(
+		query,
+		uid,
+		now,
+		totalPrice,
+		shippingService,
+		shippingCost,
+		models.OrderStatusPendingPayment,
+	).Scan(&orderId); err != nil {
+		return 0, err
+	}
+
+	query = `
+    INSERT INTO order_status_history (order_id, to_status, changed_by, changed_at)
+    VALUES ($1, $2, $3, $4);
+    `
+	if _, err := tx.Exec(query, orderId, models.OrderStatusPendingPayment, uid, now); err != nil {
+		return 0, err
+	}
+
+	// insert books into order_book table
+	query = `
+    INSERT into order_book (order_id, book_id, quantity, price_per_unit)
+    SELECT
+        $1 AS order_id,
+        book_id,
+        quantity,
+        price_per_unite
+    FROM cart
+    WHERE user_id = $2 AND book_id = ANY($3);
+    `
+	if _, err := tx.Exec(query, orderId, uid, pq.Array(bids)); err != nil {
+		return 0, err
+	}
+
+	// take the stock
+	query = `
+    UPDATE books b
+    SET quantity = b.quantity - c.quantity,
+        purchase_count = COALESCE(b.purchase_count, 0) + c.quantity
+    FROM cart c
+    WHERE c.book_id = b.id AND c.user_id = $1 AND c.book_id = ANY($2);
+    `
+	if _, err := tx.Exec(query, uid, pq.Array(bids)); err != nil {
+		return 0, err
+	}
+
+	// clear cart
+	query = `DELETE FROM cart WHERE user_id = $1 AND book_id = ANY($2);`
+	if _, err := tx.Exec(query, uid, pq.Array(bids)); err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return orderId, nil
+}
+
+// orderColumns are the orders columns read by scanOrder, in order.
+const orderColumns = `
+        orders.id,
+        orders.user_id,
+        orders.applied_at,
+        orders.total_price,
+        COALESCE(orders.shipping_service, ''),
+        orders.shipping_cost,
+        orders.tracking_number,
+        orders.status
+    `
+
+// orderDest returns the scan destinations matching orderColumns.
+func orderDest(order *models.Order) []any {
+	return []any{
+		&order.Id,
+		&order.UserId,
+		&order.AppliedAt,
+		&order.TotalPrice,
+		&order.ShippingService,
+		&order.ShippingCost,
+		&order.TrackingNumber,
+		&order.Status,
+	}
+}
+
+func scanOrder(row scanner) (*models.Order, error) {
+	order := models.Order{}
+	if err := row.Scan(orderDest(&order)...); err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
+// scanOrders reads every order from rows, then loads their books.
+func (dbs *DBService) scanOrders(rows *sql.Rows) ([]*models.Order, error) {
+	orders := make([]*models.Order, 0)
+
+	for rows.Next() {
+		order, err := scanOrder(rows)
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, order)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	for _, order := range orders {
+		orderBooks, err := dbs.getOrderBooks(order.Id)
+		if err != nil {
+			return nil, err
+		}
+		order.OrderBooks = orderBooks
+	}
+
+	return orders, nil
+}
+
+// GetAllOrdersByUser lists a page of the user's orders, newest first. see
+// GetAllOrders for after.
+func (dbs *DBService) GetAllOrdersByUser(uid int, after *models.OrderCursor, page, limit int) ([]*models.Order, error) {
+	query, args := orderPageQuery([]string{"orders.user_id = $1"}, []any{uid}, after, page, limit)
+	rows, err := dbs.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return dbs.scanOrders(rows)
+}
+
+func (dbs *DBService) GetTotalOrdersByUser(uid int) (int, error) {
+	query := `SELECT COUNT(*) FROM orders WHERE user_id = $1;`
+	var count int
+	if err := dbs.db.QueryRow(query, uid).Scan(&count); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// orderPageQuery selects a page of the orders matching conds newest first.
+// given a cursor the page starts right after the cursor's order, otherwise
+// it's the page'th page.
+func orderPageQuery(conds []string, args []any, after *models.OrderCursor, page, limit int) (string, []any) {
+	offset := (page - 1) * limit
+	if after != nil {
+		args = append(args, after.AppliedAt, after.Id)
+		conds = append(conds, fmt.Sprintf("(orders.applied_at, orders.id) < ($%d, $%d)", len(args)-1, len(args)))
+		offset = 0
+	}
+	query := `SELECT ` + orderColumns + ` FROM orders`
+	if len(conds) > 0 {
+		query += " WHERE " + strings.Join(conds, " AND ")
+	}
+	args = append(args, offset, limit)
+	query += fmt.Sprintf(" ORDER BY orders.applied_at DESC, orders.id DESC OFFSET $%d LIMIT $%d", len(args)-1, len(args))
+	return query + ";", args
+}
+
+func (dbs *DBService) getOrderBooks(id int) ([]*models.OrderBook, error) {
+	query := `
+    SELECT
+        book_id,
+        quantity,
+        price_per_unit
+    FROM order_book
+    WHERE order_id = $1;
+    `
+	rows, err := dbs.db.Query(query, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	orderBooks := make([]*models.OrderBook, 0)
+
+	for rows.Next() {
+		book := models.OrderBook{}
+		if err := rows.Scan(
+			&book.BookId,
+			&book.Quantity,
+			&book.PricePerUnite,
+		); err != nil {
+			return nil, err
+		}
+		orderBooks = append(orderBooks, &book)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return orderBooks, nil
+}
+
+// GetAllOrders lists a page of orders newest first. with a cursor the page
+// starts right after the cursor's order.
+func (dbs *DBService) GetAllOrders(after *models.OrderCursor, page, limit int) ([]*models.Order, error) {
+	query, args := orderPageQuery(nil, nil, after, page, limit)
+	rows, err := dbs.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return dbs.scanOrders(rows)
+}
+
+func (dbs *DBService) GetTotalOrders() (int, error) {
+	query := `SELECT COUNT(*) FROM orders;`
+	var count int
+	if err := dbs.db.QueryRow(query).Scan(&count); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func (dbs *DBService) GetOrderById(id int) (*models.Order, error) {
+	query := `SELECT ` + orderColumns + ` FROM orders WHERE id = $1;`
+	order, err := scanOrder(dbs.db.QueryRow(query, id))
+	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, nil
 		}
 		return nil, err
 	}
-	return &cb, nil
-}
 
-func (dbs *DBService) GetBooksInCart(uid int) ([]*models.CartBook, error) {
-	query := `SELECT book_id, quantity, price_per_unite FROM cart WHERE user_id = $1;`
+	orderBooks, err := dbs.getOrderBooks(order.Id)
+	if err != nil {
+		return nil, err
+	}
+	order.OrderBooks = orderBooks
+
+	history, err := dbs.getOrderStatusHistory(order.Id)
+	if err != nil {
+		return nil, err
+	}
+	order.StatusHistory = history
+
+	return order, nil
+}
 
-	rows, err := dbs.db.Query(query, uid)
+func (dbs *DBService) getOrderStatusHistory(id int) ([]*models.OrderStatusChange, error) {
+	query := `
+    SELECT
+        from_status,
+        to_status,
+        changed_by,
+        changed_at
+    FROM order_status_history
+    WHERE order_id = $1
+    ORDER BY changed_at, id;
+    `
+	rows, err := dbs.db.Query(query, id)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	books := make([]*models.CartBook, 0)
+	history := make([]*models.OrderStatusChange, 0)
 
 	for rows.Next() {
-		book := models.CartBook{UserId: uid}
+		change := models.OrderStatusChange{}
 		if err := rows.Scan(
-			&book.BookId,
-			&book.Quantity,
-			&book.PricePerUnite,
+			&change.FromStatus,
+			&change.ToStatus,
+			&change.ChangedBy,
+			&change.ChangedAt,
 		); err != nil {
 			return nil, err
 		}
-		books = append(books, &book)
+		history = append(history, &change)
 	}
 	if err := rows.Err(); err != nil {
 		return nil, err
 	}
 
-	return books, nil
+	return history, nil
 }
 
-func (dbs *DBService) DeleteBookFromCart(uid, bid int) error {
-	query := `DELETE FROM cart WHERE user_id = $1 AND book_id = $2;`
-	if _, err := dbs.db.Exec(query, uid, bid); err != nil {
+// UpdateOrderStatus moves the order to the given status and records the
+// change in its history. the move has to be allowed by
+// models.CanTransitionOrderStatus. cancelling an order returns its books to
+// stock. an actorId of 0 records the change as made by the system.
+func (dbs *DBService) UpdateOrderStatus(id int, status string, actorId int) error {
+	tx, err := dbs.db.Begin()
+	if err != nil {
 		return err
 	}
-	return nil
+	defer tx.Rollback()
+
+	if err := updateOrderStatusTx(tx, id, status, actorId); err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
-// --------------------------------------------------
-// > order
-// --------------------------------------------------
-func (dbs *DBService) MakeOrder(uid int) error {
+func (dbs *DBService) GetCartWeight(uid int) (int, error) {
+	query := `
+    SELECT COALESCE(SUM(b.weight_grams * c.quantity), 0)
+    FROM cart c
+    JOIN books b ON b.id = c.book_id
+    WHERE c.user_id = $1;
+    `
+	var weight int
+	if err := dbs.db.QueryRow(query, uid).Scan(&weight); err != nil {
+		return 0, err
+	}
+	return weight, nil
+}
+
+func (dbs *DBService) GetOrderWeight(id int) (int, error) {
+	query := `
+    SELECT COALESCE(SUM(b.weight_grams * ob.quantity), 0)
+    FROM order_book ob
+    JOIN books b ON b.id = ob.book_id
+    WHERE ob.order_id = $1;
+    `
+	var weight int
+	if err := dbs.db.QueryRow(query, id).Scan(&weight); err != nil {
+		return 0, err
+	}
+	return weight, nil
+}
+
+// ShipOrder moves the order to shipped and stores the carrier's tracking number.
+func (dbs *DBService) ShipOrder(id int, trackingNumber string, actorId int) error {
 	tx, err := dbs.db.Begin()
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
 
-	// get cart items
-	books, err := dbs.GetBooksInCart(uid)
-	if err != nil {
+	if err := updateOrderStatusTx(tx, id, models.OrderStatusShipped, actorId); err != nil {
 		return err
 	}
-	if len(books) == 0 {
-		return nil
+
+	query := `UPDATE orders SET tracking_number = $1 WHERE id = $2;`
+	if _, err := tx.Exec(query, trackingNumber, id); err != nil {
+		return err
 	}
 
-	// count total price
-	totalPrice := 0.0
-	for _, book := range books {
-		totalPrice += float64(book.Quantity) * book.PricePerUnite
+	return tx.Commit()
+}
+
+// CancelOrder cancels the order and, in the same transaction, marks its
+// payment to be given back: captured payments as refund_pending, authorized
+// ones as void_pending. the gateway is called once this is committed.
+func (dbs *DBService) CancelOrder(id int, actorId int) error {
+	tx, err := dbs.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := updateOrderStatusTx(tx, id, models.OrderStatusCancelled, actorId); err != nil {
+		return err
 	}
 
-	// insert new order
 	query := `
-    INSERT INTO orders (user_id, applied_at, total_price)
-    VALUES ($1, $2, $3)
-    RETURNING id;
+    UPDATE payments
+    SET
+        status = CASE status WHEN $2 THEN $3 ELSE $4 END,
+        updated_at = $5
+    WHERE order_id = $1 AND status IN ($2, $6);
     `
-	var orderId int
-	if err := tx.QueryRow(
+	if _, err := tx.Exec(
 		query,
-		uid,
+		id,
+		models.PaymentStatusCaptured,
+		models.PaymentStatusRefundPending,
+		models.PaymentStatusVoidPending,
 		time.Now().UTC(),
-		totalPrice,
-	).Scan(&orderId); err != nil {
-		tx.Rollback()
+		models.PaymentStatusAuthorized,
+	); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// restockOrderTx returns the order's books to stock and takes them back out of
+// the purchase count. books are locked in id order, like checkout does.
+func restockOrderTx(tx *sql.Tx, id int) error {
+	query := `
+    SELECT b.id
+    FROM books b
+    JOIN order_book ob ON ob.book_id = b.id
+    WHERE ob.order_id = $1
+    ORDER BY b.id
+    FOR UPDATE OF b;
+    `
+	if _, err := tx.Exec(query, id); err != nil {
 		return err
 	}
 
-	// insert books into order_book table
 	query = `
-    INSERT into order_book (order_id, book_id, quantity, price_per_unite)
-    SELECT
-        $1 AS order_id,
-        book_id,
-        quantity,
-        price_per_unite
-    FROM cart
-    WHERE user_id = $2;
+    UPDATE books b
+    SET quantity = b.quantity + ob.quantity,
+        purchase_count = GREATEST(COALESCE(b.purchase_count, 0) - ob.quantity, 0)
+    FROM order_book ob
+    WHERE ob.book_id = b.id AND ob.order_id = $1;
     `
-	if _, err := tx.Exec(query, orderId, uid); err != nil {
-		tx.Rollback()
+	if _, err := tx.Exec(query, id); err != nil {
 		return err
 	}
 
-	// clear cart
-	query = `DELETE FROM cart WHERE user_id = $1;`
-	if _, err := tx.Exec(query, uid); err != nil {
-		tx.Rollback()
+	return nil
+}
+
+func updateOrderStatusTx(tx *sql.Tx, id int, status string, actorId int) error {
+	query := `SELECT status FROM orders WHERE id = $1 FOR UPDATE;`
+	var current string
+	if err := tx.QueryRow(query, id).Scan(&current); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrOrderNotFound
+		}
 		return err
 	}
+	if !models.CanTransitionOrderStatus(current, status) {
+		return fmt.Errorf("%w from %s to %s", ErrInvalidStatusTransition, current, status)
+	}
 
-	if err := tx.Commit(); err != nil {
-		tx.Rollback()
+	query = `UPDATE orders SET status = $1 WHERE id = $2;`
+	if _, err := tx.Exec(query, status, id); err != nil {
+		return err
+	}
+
+	if status == models.OrderStatusCancelled {
+		if err := restockOrderTx(tx, id); err != nil {
+			return err
+		}
+	}
+
+	query = `
+    INSERT INTO order_status_history (order_id, from_status, to_status, changed_by, changed_at)
+    VALUES ($1, $2, $3, NULLIF($4, 0), $5);
+    `
+	if _, err := tx.Exec(query, id, current, status, actorId, time.Now().UTC()); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func (dbs *DBService) GetAllOrdersByUser(uid int) ([]*models.Order, error) {
+// --------------------------------------------------
+// > export
+// --------------------------------------------------
+
+// ExportBooks calls fn with every book, by id. books are read one row at a
+// time, so the catalog is never held in memory.
+func (dbs *DBService) ExportBooks(ctx context.Context, fn func(*models.Book) error) error {
+	query := `SELECT ` + bookColumns + ` FROM books ORDER BY books.id;`
+	rows, err := dbs.db.QueryContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		book, err := scanBook(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(book); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// ExportOrders calls fn with every order and its books, by id. the books are
+// joined in and orders are read one row at a time.
+func (dbs *DBService) ExportOrders(ctx context.Context, fn func(*models.Order) error) error {
 	query := `
-    SELECT
-        id,
-        applied_at,
-        total_price,
+    SELECT ` + orderColumns + `,
+        order_book.book_id,
+        order_book.quantity,
+        order_book.price_per_unit
     FROM orders
-    WHERE user_id = $1;
+    LEFT JOIN order_book ON order_book.order_id = orders.id
+    ORDER BY orders.id, order_book.book_id;
     `
-	rows, err := dbs.db.Query(query, uid)
+	rows, err := dbs.db.QueryContext(ctx, query)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer rows.Close()
 
-	orders := make([]*models.Order, 0)
-
+	var order *models.Order
 	for rows.Next() {
-		order := models.Order{UserId: uid}
-		if err := rows.Scan(
-			&order.Id,
-			&order.AppliedAt,
-			&order.TotalPrice,
-		); err != nil {
-			return nil, err
+		row := models.Order{}
+		var (
+			bookId, quantity sql.NullInt64
+			pricePerUnit     sql.NullFloat64
+		)
+		if err := rows.Scan(append(orderDest(&row), &bookId, &quantity, &pricePerUnit)...); err != nil {
+			return err
+		}
+
+		if order == nil || order.Id != row.Id {
+			if order != nil {
+				if err := fn(order); err != nil {
+					return err
+				}
+			}
+			order = &row
+			order.OrderBooks = make([]*models.OrderBook, 0)
+		}
+		if bookId.Valid {
+			order.OrderBooks = append(order.OrderBooks, &models.OrderBook{
+				BookId:        int(bookId.Int64),
+				Quantity:      int(quantity.Int64),
+				PricePerUnite: pricePerUnit.Float64,
+			})
 		}
-		orders = append(orders, &order)
 	}
 	if err := rows.Err(); err != nil {
-		return nil, err
+		return err
 	}
 
-	for _, order := range orders {
-		orderBooks, err := dbs.getOrderBooks(order.Id)
-		if err != nil {
-			return nil, err
-		}
-		order.OrderBooks = orderBooks
+	if order != nil {
+		return fn(order)
 	}
-
-	return orders, nil
+	return nil
 }
 
-func (dbs *DBService) getOrderBooks(id int) ([]*models.OrderBook, error) {
+// ExportUsers calls fn with every user, by id, without their password hash.
+func (dbs *DBService) ExportUsers(ctx context.Context, fn func(*models.User) error) error {
 	query := `
     SELECT
-        book_id,
-        quantity,
-        price_per_unite
-    FROM order_book
-    WHERE order_id = $1;
+        id,
+        name,
+        email,
+        username,
+        address,
+        role,
+        joined_at,
+        verified_at
+    FROM users
+    ORDER BY id;
     `
-	rows, err := dbs.db.Query(query, id)
+	rows, err := dbs.db.QueryContext(ctx, query)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer rows.Close()
 
-	orderBooks := make([]*models.OrderBook, 0)
-
 	for rows.Next() {
-		book := models.OrderBook{}
+		user := models.User{}
 		if err := rows.Scan(
-			&book.BookId,
-			&book.Quantity,
-			&book.PricePerUnite,
+			&user.Id,
+			&user.Name,
+			&user.Email,
+			&user.Username,
+			&user.Address,
+			&user.Role,
+			&user.JoinedAt,
+			&user.VerifiedAt,
 		); err != nil {
-			return nil, err
+			return err
+		}
+		if err := fn(&user); err != nil {
+			return err
 		}
 	}
-	if err := rows.Err(); err != nil {
-		return nil, err
+	return rows.Err()
+}
+
+// --------------------------------------------------
+// > payment
+// --------------------------------------------------
+func (dbs *DBService) CreatePayment(inout *models.Payment) error {
+	query := `
+    INSERT INTO payments (order_id, provider_ref, amount, status, created_at, updated_at)
+    VALUES ($1, $2, $3, $4, $5, $5)
+    RETURNING id;
+    `
+	if err := dbs.db.QueryRow(
+		query,
+		inout.OrderId,
+		inout.ProviderRef,
+		inout.Amount,
+		inout.Status,
+		inout.CreatedAt,
+	).Scan(&inout.Id); err != nil {
+		return err
 	}
+	return nil
+}
 
-	return orderBooks, nil
+func (dbs *DBService) GetPaymentByOrderId(oid int) (*models.Payment, error) {
+	query := `
+    SELECT
+        id,
+        provider_ref,
+        amount,
+        status,
+        created_at,
+        updated_at
+    FROM payments
+    WHERE order_id = $1;
+    `
+	p := models.Payment{OrderId: oid}
+	if err := dbs.db.QueryRow(query, oid).Scan(
+		&p.Id,
+		&p.ProviderRef,
+		&p.Amount,
+		&p.Status,
+		&p.CreatedAt,
+		&p.UpdatedAt,
+	); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &p, nil
 }
 
-func (dbs *DBService) GetAllOrders() ([]*models.Order, error) {
+// GetUnsettledPayments returns the payments of cancelled orders still waiting
+// for their refund or void, last updated before t.
+func (dbs *DBService) GetUnsettledPayments(before time.Time) ([]*models.Payment, error) {
 	query := `
     SELECT
         id,
-        user_id,
-        applied_at,
-        total_price,
-    FROM orders;
+        order_id,
+        provider_ref,
+        amount,
+        status,
+        created_at,
+        updated_at
+    FROM payments
+    WHERE status IN ($1, $2) AND updated_at < $3
+    ORDER BY updated_at;
     `
-	rows, err := dbs.db.Query(query)
+	rows, err := dbs.db.Query(query, models.PaymentStatusRefundPending, models.PaymentStatusVoidPending, before)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	orders := make([]*models.Order, 0)
+	payments := make([]*models.Payment, 0)
 
 	for rows.Next() {
-		order := models.Order{}
+		p := models.Payment{}
 		if err := rows.Scan(
-			&order.Id,
-			&order.UserId,
-			&order.AppliedAt,
-			&order.TotalPrice,
+			&p.Id,
+			&p.OrderId,
+			&p.ProviderRef,
+			&p.Amount,
+			&p.Status,
+			&p.CreatedAt,
+			&p.UpdatedAt,
 		); err != nil {
 			return nil, err
 		}
-		orders = append(orders, &order)
+		payments = append(payments, &p)
 	}
 	if err := rows.Err(); err != nil {
 		return nil, err
 	}
 
-	for _, order := range orders {
-		orderBooks, err := dbs.getOrderBooks(order.Id)
-		if err != nil {
-			return nil, err
-		}
-		order.OrderBooks = orderBooks
-	}
+	return payments, nil
+}
 
-	return orders, nil
+func (dbs *DBService) UpdatePayment(p *models.Payment) error {
+	query := `
+    UPDATE payments
+    SET
+        provider_ref = $1,
+        status = $2,
+        updated_at = $3
+    WHERE id = $4;
+    `
+	if _, err := dbs.db.Exec(
+		query,
+		p.ProviderRef,
+		p.Status,
+		p.UpdatedAt,
+		p.Id,
+	); err != nil {
+		return err
+	}
+	return nil
 }
 
-func (dbs *DBService) GetOrderById(id int) (*models.Order, error) {
+// --------------------------------------------------
+// > idempotency
+// --------------------------------------------------
+
+// ClaimIdempotencyKey stores a new in-flight record for the key. a record for
+// the same request still in flight since before staleBefore is taken over. if
+// the user already used the key otherwise, it returns the existing record and
+// false instead.
+func (dbs *DBService) ClaimIdempotencyKey(inout *models.IdempotencyRecord, staleBefore time.Time) (bool, error) {
 	query := `
+    INSERT INTO idempotency_keys (user_id, key, request_hash, created_at)
+    VALUES ($1, $2, $3, $4)
+    ON CONFLICT (user_id, key) DO UPDATE
+    SET created_at = EXCLUDED.created_at
+    WHERE idempotency_keys.status_code IS NULL
+        AND idempotency_keys.request_hash = EXCLUDED.request_hash
+        AND idempotency_keys.created_at < $5;
+    `
+	res, err := dbs.db.Exec(query, inout.UserId, inout.Key, inout.RequestHash, inout.CreatedAt, staleBefore)
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return false, err
+	} else if n == 1 {
+		return true, nil
+	}
+
+	query = `
     SELECT
-        user_id,
-        applied_at,
-        total_price
-    FROM orders
-    WHERE id = $1;
+        request_hash,
+        status_code,
+        COALESCE(content_type, ''),
+        response_body,
+        created_at
+    FROM idempotency_keys
+    WHERE user_id = $1 AND key = $2;
     `
-	order := models.Order{Id: id}
-	if err := dbs.db.QueryRow(query, id).Scan(
-		&order.UserId,
-		&order.AppliedAt,
-		&order.TotalPrice,
+	if err := dbs.db.QueryRow(query, inout.UserId, inout.Key).Scan(
+		&inout.RequestHash,
+		&inout.StatusCode,
+		&inout.ContentType,
+		&inout.ResponseBody,
+		&inout.CreatedAt,
 	); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return nil, nil
-		}
-		return nil, err
+		return false, err
 	}
+	return false, nil
+}
 
-	orderBooks, err := dbs.getOrderBooks(order.Id)
-	if err != nil {
-		return nil, err
+func (dbs *DBService) CompleteIdempotencyKey(rec *models.IdempotencyRecord) error {
+	query := `
+    UPDATE idempotency_keys
+    SET
+        status_code = $1,
+        content_type = $2,
+        response_body = $3
+    WHERE user_id = $4 AND key = $5;
+    `
+	if _, err := dbs.db.Exec(
+		query,
+		rec.StatusCode,
+		rec.ContentType,
+		rec.ResponseBody,
+		rec.UserId,
+		rec.Key,
+	); err != nil {
+		return err
 	}
-	order.OrderBooks = orderBooks
+	return nil
+}
 
-	return &order, nil
+func (dbs *DBService) DeleteIdempotencyKey(uid int, key string) error {
+	query := `DELETE FROM idempotency_keys WHERE user_id = $1 AND key = $2;`
+	if _, err := dbs.db.Exec(query, uid, key); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (dbs *DBService) DeleteIdempotencyKeysBefore(t time.Time) (int64, error) {
+	query := `DELETE FROM idempotency_keys WHERE created_at < $1;`
+	res, err := dbs.db.Exec(query, t)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
 }
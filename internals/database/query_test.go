@@ -0,0 +1,226 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/assaidy/bookstore/internals/database/dbtest"
+	"github.com/assaidy/bookstore/internals/models"
+)
+
+// these tests need a real postgres, see dbtest.
+
+func newTestDBService(t *testing.T) *DBService {
+	t.Helper()
+	return &DBService{db: dbtest.Open(t)}
+}
+
+func mustExec(t *testing.T, dbs *DBService, query string, args ...any) {
+	t.Helper()
+	if _, err := dbs.db.Exec(query, args...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func mustQueryInt(t *testing.T, dbs *DBService, query string, args ...any) int {
+	t.Helper()
+	var n int
+	if err := dbs.db.QueryRow(query, args...).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func createTestUser(t *testing.T, dbs *DBService, username string) int {
+	t.Helper()
+	return mustQueryInt(t, dbs, `
+    INSERT INTO users (name, username, password, email, address)
+    VALUES ($1, $1, 'x', $1 || '@example.com', 'somewhere')
+    RETURNING id;
+    `, username)
+}
+
+func createTestCategory(t *testing.T, dbs *DBService, name string) int {
+	t.Helper()
+	return mustQueryInt(t, dbs, `INSERT INTO categories (name) VALUES ($1) RETURNING id;`, name)
+}
+
+func createTestBook(t *testing.T, dbs *DBService, cid int, title string, quantity, purchaseCount int) int {
+	t.Helper()
+	return mustQueryInt(t, dbs, `
+    INSERT INTO books (title, description, category_id, price, quantity, weight_grams, purchase_count)
+    VALUES ($1, '', $2, 10, $3, 500, $4)
+    RETURNING id;
+    `, title, cid, quantity, purchaseCount)
+}
+
+// TestMakeOrderConcurrentStock has more buyers than copies of a book check out
+// at once. exactly as many orders as there are copies must go through, the
+// others fail with ErrInsufficientStock, and the stock ends at 0.
+func TestMakeOrderConcurrentStock(t *testing.T) {
+	dbs := newTestDBService(t)
+
+	const (
+		stock  = 5
+		buyers = 20
+	)
+	cid := createTestCategory(t, dbs, "fiction")
+	bid := createTestBook(t, dbs, cid, "dune", stock, 0)
+	uids := make([]int, buyers)
+	for i := range uids {
+		uids[i] = createTestUser(t, dbs, fmt.Sprintf("buyer%d", i))
+		// every cart holds the book with an expired reservation, so nothing
+		// but checkout itself stands between the buyers and the stock
+		mustExec(t, dbs, `
+        INSERT INTO cart (user_id, book_id, quantity, price_per_unite, reserved_until)
+        VALUES ($1, $2, 1, 10, $3);
+        `, uids[i], bid, time.Now().UTC().Add(-time.Minute))
+	}
+
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	errs := make([]error, buyers)
+	for i, uid := range uids {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			_, errs[i] = dbs.MakeOrder(uid, 500, "standard", 0)
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	ordered := 0
+	for i, err := range errs {
+		switch {
+		case err == nil:
+			ordered++
+		case errors.Is(err, ErrInsufficientStock):
+		default:
+			t.Errorf("buyer %d: unexpected error: %v", i, err)
+		}
+	}
+	if ordered != stock {
+		t.Errorf("%d orders went through, want %d", ordered, stock)
+	}
+
+	if n := mustQueryInt(t, dbs, `SELECT quantity FROM books WHERE id = $1;`, bid); n != 0 {
+		t.Errorf("stock is %d after checkout, want 0", n)
+	}
+	if n := mustQueryInt(t, dbs, `SELECT COALESCE(SUM(quantity), 0) FROM order_book WHERE book_id = $1;`, bid); n != stock {
+		t.Errorf("%d copies were ordered, want %d", n, stock)
+	}
+}
+
+func createTestOrder(t *testing.T, dbs *DBService, uid int, status string, bids ...int) {
+	t.Helper()
+	oid := mustQueryInt(t, dbs, `
+    INSERT INTO orders (user_id, total_price, status) VALUES ($1, $2, $3) RETURNING id;
+    `, uid, 10*len(bids), status)
+	for _, bid := range bids {
+		mustExec(t, dbs, `
+        INSERT INTO order_book (order_id, book_id, quantity, price_per_unit) VALUES ($1, $2, 1, 10);
+        `, oid, bid)
+	}
+}
+
+// TestRefreshUserRecommendationsRanking seeds a user with one favourite and one
+// bought book, and checks the exact ranking: category weights, co-purchases
+// from other users' orders, the purchase_count then id tie-break, and that
+// seeds, out of stock books and cancelled orders are left out.
+func TestRefreshUserRecommendationsRanking(t *testing.T) {
+	dbs := newTestDBService(t)
+
+	alice := createTestUser(t, dbs, "alice")
+	bob := createTestUser(t, dbs, "bob")
+
+	fiction := createTestCategory(t, dbs, "fiction")
+	science := createTestCategory(t, dbs, "science")
+	history := createTestCategory(t, dbs, "history")
+
+	f1 := createTestBook(t, dbs, fiction, "f1", 10, 0) // favourited by alice
+	f2 := createTestBook(t, dbs, fiction, "f2", 10, 5)
+	f3 := createTestBook(t, dbs, fiction, "f3", 10, 5) // ties f2, higher id
+	f4 := createTestBook(t, dbs, fiction, "f4", 10, 9)
+	createTestBook(t, dbs, fiction, "f5", 0, 20)       // out of stock
+	s1 := createTestBook(t, dbs, science, "s1", 10, 0) // bought by alice
+	s2 := createTestBook(t, dbs, science, "s2", 10, 0)
+	h1 := createTestBook(t, dbs, history, "h1", 10, 0)
+	h2 := createTestBook(t, dbs, history, "h2", 10, 1)
+	h3 := createTestBook(t, dbs, history, "h3", 10, 0)
+
+	mustExec(t, dbs, `INSERT INTO favourites (user_id, book_id) VALUES ($1, $2);`, alice, f1)
+	createTestOrder(t, dbs, alice, models.OrderStatusDelivered, s1)
+	createTestOrder(t, dbs, bob, models.OrderStatusDelivered, s1, h1)
+	createTestOrder(t, dbs, bob, models.OrderStatusPendingPayment, s1, h1)
+	createTestOrder(t, dbs, bob, models.OrderStatusPaid, s1, h2)
+	createTestOrder(t, dbs, bob, models.OrderStatusCancelled, s1, h3)
+
+	if err := dbs.RefreshBookAffinities(); err != nil {
+		t.Fatal(err)
+	}
+	if err := dbs.RefreshUserRecommendations(); err != nil {
+		t.Fatal(err)
+	}
+
+	// fiction weighs 3 (favourite), science 2 (purchase), and history books
+	// 2 per order they share with s1
+	want := []struct {
+		bookId int
+		score  float64
+	}{
+		{h1, 4},
+		{f4, 3},
+		{f2, 3},
+		{f3, 3},
+		{h2, 2}, // ties s2, bought more
+		{s2, 2},
+	}
+
+	rows, err := dbs.db.Query(`
+    SELECT book_id, score, rank FROM user_recommendations WHERE user_id = $1 ORDER BY rank;
+    `, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	i := 0
+	for ; rows.Next(); i++ {
+		var bid, rank int
+		var score float64
+		if err := rows.Scan(&bid, &score, &rank); err != nil {
+			t.Fatal(err)
+		}
+		if i >= len(want) {
+			t.Errorf("unexpected recommendation of book %d at rank %d", bid, rank)
+			continue
+		}
+		if bid != want[i].bookId || score != want[i].score || rank != i+1 {
+			t.Errorf("rank %d: got book %d (score %v, rank %d), want book %d (score %v)",
+				i+1, bid, score, rank, want[i].bookId, want[i].score)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if i < len(want) {
+		t.Errorf("got %d recommendations, want %d", i, len(want))
+	}
+
+	books, err := dbs.GetUserRecommendations(alice, len(want)+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(books) != len(want) {
+		t.Fatalf("GetUserRecommendations returned %d books, want %d", len(books), len(want))
+	}
+	for i, book := range books {
+		if book.Id != want[i].bookId {
+			t.Errorf("GetUserRecommendations[%d] is book %d, want %d", i, book.Id, want[i].bookId)
+		}
+	}
+}
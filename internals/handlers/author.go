@@ -0,0 +1,141 @@
+package handlers
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/assaidy/bookstore/internals/database"
+	"github.com/assaidy/bookstore/internals/models"
+	"github.com/assaidy/bookstore/internals/utils"
+	"github.com/gofiber/fiber/v2"
+)
+
+type AuthorHandler struct {
+	db *database.DBService
+}
+
+func NewAuthorHandler(db *database.DBService) *AuthorHandler {
+	return &AuthorHandler{db: db}
+}
+
+func (h *AuthorHandler) HandleCreateAuthor(c *fiber.Ctx) error {
+	req := models.AuthorCreateOrUpdateReq{}
+	if err := parseAndValidateReq(c, &req); err != nil {
+		return err
+	}
+
+	author := models.Author{
+		Name: strings.TrimSpace(req.Name),
+		Bio:  strings.TrimSpace(req.Bio),
+	}
+	if err := h.db.CreateAuthor(&author); err != nil {
+		return utils.InternalServerError(err)
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(utils.ApiResponse{
+		Message: "created successfully",
+		Data:    fiber.Map{"author": author},
+	})
+}
+
+func (h *AuthorHandler) HandleGetAllAuthors(c *fiber.Ctx) error {
+	authors, err := h.db.GetAllAuthors()
+	if err != nil {
+		return utils.InternalServerError(err)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(utils.ApiResponse{
+		Message: "retrieved successfully",
+		Data:    fiber.Map{"authors": authors},
+	})
+}
+
+func (h *AuthorHandler) HandleGetAuthorById(c *fiber.Ctx) error {
+	id, _ := c.ParamsInt("id")
+
+	author, err := h.db.GetAuthorById(id)
+	if err != nil {
+		return utils.InternalServerError(err)
+	}
+	if author == nil {
+		return utils.NotFoundError(fmt.Sprintf("author with id %d not found", id))
+	}
+
+	return c.Status(fiber.StatusOK).JSON(utils.ApiResponse{
+		Message: "retrieved successfully",
+		Data:    fiber.Map{"author": author},
+	})
+}
+
+// HandleGetAllBooksByAuthor lists the author's books like GET /book, with
+// 'sorting' defaulting to latest and the other filters still applying.
+func (h *AuthorHandler) HandleGetAllBooksByAuthor(c *fiber.Ctx) error {
+	id, _ := c.ParamsInt("id") // author id
+
+	if ok, err := h.db.CheckIfAuthorExists(id); err != nil {
+		return utils.InternalServerError(err)
+	} else if !ok {
+		return utils.NotFoundError(fmt.Sprintf("author with id %d not found", id))
+	}
+
+	sorting := "latest"
+	if c.Query("sorting") != "" {
+		var err error
+		if sorting, err = getSortingTechnique(c); err != nil {
+			return utils.BadRequestError(err.Error())
+		}
+	}
+	filter, err := getBookFilter(c)
+	if err != nil {
+		return utils.BadRequestError(err.Error())
+	}
+	filter.AuthorIds = []int{id}
+
+	return listBooks(c, h.db, sorting, filter)
+}
+
+func (h *AuthorHandler) HandleUpdateAuthorById(c *fiber.Ctx) error {
+	req := models.AuthorCreateOrUpdateReq{}
+	if err := parseAndValidateReq(c, &req); err != nil {
+		return err
+	}
+
+	id, _ := c.ParamsInt("id")
+
+	author, err := h.db.GetAuthorById(id)
+	if err != nil {
+		return utils.InternalServerError(err)
+	}
+	if author == nil {
+		return utils.NotFoundError(fmt.Sprintf("author with id %d not found", id))
+	}
+
+	author.Name = strings.TrimSpace(req.Name)
+	author.Bio = strings.TrimSpace(req.Bio)
+	if err := h.db.UpdateAuthor(author); err != nil {
+		return utils.InternalServerError(err)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(utils.ApiResponse{
+		Message: "updated successfully",
+		Data:    fiber.Map{"author": author},
+	})
+}
+
+func (h *AuthorHandler) HandleDeleteAuthorById(c *fiber.Ctx) error {
+	id, _ := c.ParamsInt("id")
+
+	if ok, err := h.db.CheckIfAuthorExists(id); err != nil {
+		return utils.InternalServerError(err)
+	} else if !ok {
+		return utils.NotFoundError(fmt.Sprintf("author with id %d not found", id))
+	}
+
+	if err := h.db.DeleteAuthor(id); err != nil {
+		return utils.InternalServerError(err)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(utils.ApiResponse{
+		Message: "deleted successfully",
+	})
+}
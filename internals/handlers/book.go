@@ -1,7 +1,10 @@
 package handlers
 
 import (
+	"errors"
 	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/assaidy/bookstore/internals/database"
@@ -10,6 +13,9 @@ import (
 	"github.com/gofiber/fiber/v2"
 )
 
+// used when a book is created without a weight
+const defaultBookWeightGrams = 500
+
 type BookHandler struct {
 	db *database.DBService
 }
@@ -23,6 +29,7 @@ func (h *BookHandler) HandleCreateBook(c *fiber.Ctx) error {
 	if err := parseAndValidateReq(c, &req); err != nil {
 		return err
 	}
+	var err error
 
 	book := models.Book{
 		Title:       req.Title,
@@ -32,10 +39,25 @@ func (h *BookHandler) HandleCreateBook(c *fiber.Ctx) error {
 		Price:       req.Price,
 		Quantity:    req.Quantity,
 		Discount:    req.Discount,
+		WeightGrams: req.WeightGrams,
 		AddedAt:     time.Now().UTC(),
 	}
+	if book.WeightGrams == 0 {
+		book.WeightGrams = defaultBookWeightGrams
+	}
+	if book.Authors, err = h.getBookAuthors(req.AuthorIds); err != nil {
+		return err
+	}
+	if req.Isbn != "" {
+		if err := h.setBookIsbn(&book, req.Isbn); err != nil {
+			return err
+		}
+	}
 
 	if err := h.db.CreateBook(&book); err != nil {
+		if errors.Is(err, database.ErrIsbnConflict) {
+			return utils.ConflictError(fmt.Sprintf("book with isbn %s already exists", *book.Isbn13))
+		}
 		return utils.InternalServerError(err)
 	}
 
@@ -44,6 +66,56 @@ func (h *BookHandler) HandleCreateBook(c *fiber.Ctx) error {
 	})
 }
 
+// getBookAuthors checks that the ids are authors and returns them in the given
+// order, without duplicates.
+func (h *BookHandler) getBookAuthors(ids []int) ([]*models.BookAuthor, error) {
+	authors := make([]*models.BookAuthor, 0, len(ids))
+	seen := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			authors = append(authors, &models.BookAuthor{Id: id})
+		}
+	}
+	if len(authors) == 0 {
+		return authors, nil
+	}
+
+	uniqueIds := make([]int, 0, len(authors))
+	for _, a := range authors {
+		uniqueIds = append(uniqueIds, a.Id)
+	}
+	if ok, err := h.db.CheckIfAuthorsExist(uniqueIds); err != nil {
+		return nil, utils.InternalServerError(err)
+	} else if !ok {
+		return nil, utils.InvalidDataError("some of the authors don't exist")
+	}
+	return authors, nil
+}
+
+// setBookIsbn sets both ISBN forms of the book from an already validated
+// ISBN-10 or ISBN-13, unless another book has it.
+func (h *BookHandler) setBookIsbn(book *models.Book, isbn string) error {
+	isbn13, err := utils.NormalizeISBN(isbn)
+	if err != nil {
+		return utils.InvalidDataError(err.Error())
+	}
+	if book.Isbn13 == nil || *book.Isbn13 != isbn13 {
+		if ok, err := h.db.CheckIsbnConflict(isbn13); err != nil {
+			return utils.InternalServerError(err)
+		} else if ok {
+			return utils.ConflictError(fmt.Sprintf("book with isbn %s already exists", isbn13))
+		}
+	}
+
+	book.Isbn13 = &isbn13
+	book.Isbn10 = nil
+	if isbn10, ok := utils.ISBN13To10(isbn13); ok {
+		book.Isbn10 = &isbn10
+	}
+	return nil
+}
+
 func getSortingTechnique(c *fiber.Ctx) (string, error) {
 	st := c.Query("sorting")
 	if st == "" {
@@ -76,32 +148,219 @@ func getPaginationData(c *fiber.Ctx) (page, limit int) {
 	return page, limit
 }
 
+// getIdsParam reads ids given as a repeated or comma separated query param.
+func getIdsParam(c *fiber.Ctx, name string) ([]int, error) {
+	var ids []int
+	for _, v := range c.Context().QueryArgs().PeekMulti(name) {
+		for _, part := range strings.Split(string(v), ",") {
+			id, err := strconv.Atoi(strings.TrimSpace(part))
+			if err != nil || id < 1 {
+				return nil, fmt.Errorf("'%s' param takes only %s ids", name, name)
+			}
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// getBookFilter reads the listing filters from the query:
+//   - category: one or more category ids, repeated or comma separated
+//   - author: one or more author ids, the same way
+//   - minPrice, maxPrice: bounds on the discounted price
+//   - inStock, discounted: booleans
+//   - addedAfter: a date (2006-01-02) or RFC 3339 timestamp
+func getBookFilter(c *fiber.Ctx) (*models.BookFilter, error) {
+	f := models.BookFilter{}
+
+	var err error
+	if f.CategoryIds, err = getIdsParam(c, "category"); err != nil {
+		return nil, err
+	}
+	if f.AuthorIds, err = getIdsParam(c, "author"); err != nil {
+		return nil, err
+	}
+
+	for name, out := range map[string]**float64{"minPrice": &f.MinPrice, "maxPrice": &f.MaxPrice} {
+		v := c.Query(name)
+		if v == "" {
+			continue
+		}
+		price, err := strconv.ParseFloat(v, 64)
+		if err != nil || price < 0 {
+			return nil, fmt.Errorf("'%s' param takes only non-negative numbers", name)
+		}
+		*out = &price
+	}
+	if f.MinPrice != nil && f.MaxPrice != nil && *f.MinPrice > *f.MaxPrice {
+		return nil, fmt.Errorf("'minPrice' can't be greater than 'maxPrice'")
+	}
+
+	for name, out := range map[string]*bool{"inStock": &f.InStock, "discounted": &f.Discounted} {
+		v := c.Query(name)
+		if v == "" {
+			continue
+		}
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("'%s' param takes only values {true, false}", name)
+		}
+		*out = b
+	}
+
+	if v := c.Query("addedAfter"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			if t, err = time.Parse(time.DateOnly, v); err != nil {
+				return nil, fmt.Errorf("'addedAfter' param takes only dates like 2006-01-02 or RFC 3339 timestamps")
+			}
+		}
+		t = t.UTC()
+		f.AddedAfter = &t
+	}
+
+	return &f, nil
+}
+
+// getBookCursor reads the optional 'cursor' param, which must have been
+// issued for the same sorting.
+func getBookCursor(c *fiber.Ctx, sorting string) (*models.BookCursor, error) {
+	v := c.Query("cursor")
+	if v == "" {
+		return nil, nil
+	}
+	cursor := models.BookCursor{}
+	if err := utils.DecodeCursor(v, &cursor); err != nil {
+		return nil, fmt.Errorf("'cursor' param is invalid")
+	}
+	if cursor.Sorting != sorting {
+		return nil, fmt.Errorf("'cursor' param was issued for sorting '%s'", cursor.Sorting)
+	}
+	return &cursor, nil
+}
+
+// getFacetsFlag reports whether the listing should include facet counts.
+func getFacetsFlag(c *fiber.Ctx) (bool, error) {
+	v := c.Query("facets")
+	if v == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("'facets' param takes only values {true, false}")
+	}
+	return b, nil
+}
+
 func (h *BookHandler) HandleGetAllBooks(c *fiber.Ctx) error {
 	sorting, err := getSortingTechnique(c)
 	if err != nil {
 		return utils.BadRequestError(err.Error())
 	}
+	filter, err := getBookFilter(c)
+	if err != nil {
+		return utils.BadRequestError(err.Error())
+	}
+	return listBooks(c, h.db, sorting, filter)
+}
+
+// listBooks responds with a page of the books matching the filter, read from
+// the 'page', 'limit', 'cursor' and 'facets' params.
+func listBooks(c *fiber.Ctx, db *database.DBService, sorting string, filter *models.BookFilter) error {
+	withFacets, err := getFacetsFlag(c)
+	if err != nil {
+		return utils.BadRequestError(err.Error())
+	}
+	after, err := getBookCursor(c, sorting)
+	if err != nil {
+		return utils.BadRequestError(err.Error())
+	}
+	page, limit := getPaginationData(c)
+
+	books, err := db.GetAllBooks(filter, sorting, after, page, limit)
+	if err != nil {
+		return utils.InternalServerError(err)
+	}
+
+	// a full page may be followed by more books
+	var nextCursor *string
+	if len(books) == limit {
+		cursor, err := utils.EncodeCursor(models.NewBookCursor(sorting, books[len(books)-1]))
+		if err != nil {
+			return utils.InternalServerError(err)
+		}
+		nextCursor = &cursor
+	}
+
+	totalBooks, err := db.GetTotalBooks(filter)
+	if err != nil {
+		return utils.InternalServerError(err)
+	}
+	totalPages := (totalBooks + limit - 1) / limit
+
+	data := fiber.Map{
+		"books":      books,
+		"page":       page,
+		"limit":      limit,
+		"totalPages": totalPages,
+		"nextCursor": nextCursor,
+	}
+	if withFacets {
+		facets, err := db.GetBookFacets(filter)
+		if err != nil {
+			return utils.InternalServerError(err)
+		}
+		data["facets"] = facets
+	}
+
+	return c.Status(fiber.StatusOK).JSON(utils.ApiResponse{
+		Message: "retrieved successfully",
+		Data:    data,
+	})
+}
+
+func (h *BookHandler) HandleSearchBooks(c *fiber.Ctx) error {
+	filter, err := getBookFilter(c)
+	if err != nil {
+		return utils.BadRequestError(err.Error())
+	}
+	filter.Query = strings.TrimSpace(c.Query("q"))
+	if filter.Query == "" {
+		return utils.BadRequestError("plz set value for param 'q'")
+	}
+	withFacets, err := getFacetsFlag(c)
+	if err != nil {
+		return utils.BadRequestError(err.Error())
+	}
 	page, limit := getPaginationData(c)
 
-	books, err := h.db.GetAllBooks(sorting, page, limit)
+	books, err := h.db.SearchBooks(filter, page, limit)
 	if err != nil {
 		return utils.InternalServerError(err)
 	}
 
-	totalBooks, err := h.db.GetTotalBooks()
+	totalBooks, err := h.db.GetTotalBooks(filter)
 	if err != nil {
 		return utils.InternalServerError(err)
 	}
 	totalPages := (totalBooks + limit - 1) / limit
 
+	data := fiber.Map{
+		"books":      books,
+		"page":       page,
+		"limit":      limit,
+		"totalPages": totalPages,
+	}
+	if withFacets {
+		facets, err := h.db.GetBookFacets(filter)
+		if err != nil {
+			return utils.InternalServerError(err)
+		}
+		data["facets"] = facets
+	}
+
 	return c.Status(fiber.StatusOK).JSON(utils.ApiResponse{
 		Message: "retrieved successfully",
-		Data: fiber.Map{
-			"books":      books,
-			"page":       page,
-			"limit":      limit,
-			"totalPages": totalPages,
-		},
+		Data:    data,
 	})
 }
 
@@ -122,6 +381,76 @@ func (h *BookHandler) HnadleGetBookById(c *fiber.Ctx) error {
 	})
 }
 
+// HandleGetBookByIsbn finds a book by its ISBN-10 or ISBN-13, with or
+// without hyphens.
+func (h *BookHandler) HandleGetBookByIsbn(c *fiber.Ctx) error {
+	isbn13, err := utils.NormalizeISBN(c.Params("isbn"))
+	if err != nil {
+		return utils.BadRequestError(fmt.Sprintf("'%s' is not a valid isbn", c.Params("isbn")))
+	}
+
+	book, err := h.db.GetBookByIsbn(isbn13)
+	if err != nil {
+		return utils.InternalServerError(err)
+	}
+	if book == nil {
+		return utils.NotFoundError(fmt.Sprintf("book with isbn %s not found", isbn13))
+	}
+
+	return c.Status(fiber.StatusOK).JSON(utils.ApiResponse{
+		Message: "retrieved successfully",
+		Data:    fiber.Map{"book": book},
+	})
+}
+
+// HandleGetRelatedBooks lists the books customers also bought, up to the
+// 'limit' param.
+func (h *BookHandler) HandleGetRelatedBooks(c *fiber.Ctx) error {
+	id, _ := c.ParamsInt("id")
+
+	if ok, err := h.db.CheckIfBookExists(id); err != nil {
+		return utils.InternalServerError(err)
+	} else if !ok {
+		return utils.NotFoundError(fmt.Sprintf("book with id %d not found", id))
+	}
+
+	_, limit := getPaginationData(c)
+
+	books, err := h.db.GetRelatedBooks(id, limit)
+	if err != nil {
+		return utils.InternalServerError(err)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(utils.ApiResponse{
+		Message: "retrieved successfully",
+		Data:    fiber.Map{"books": books},
+	})
+}
+
+// HandleGetUserRecommendations lists the books recommended to the user, up
+// to the 'limit' param.
+func (h *BookHandler) HandleGetUserRecommendations(c *fiber.Ctx) error {
+	uid, _ := c.ParamsInt("uid")
+
+	if ok, err := h.db.CheckIfUserExists(uid); err != nil {
+		return utils.InternalServerError(err)
+	} else if !ok {
+		return utils.NotFoundError(fmt.Sprintf("user with id %d not found", uid))
+	}
+
+	_, limit := getPaginationData(c)
+
+	books, err := h.db.GetUserRecommendations(uid, limit)
+	if err != nil {
+		return utils.InternalServerError(err)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(utils.ApiResponse{
+		Message: "retrieved successfully",
+		Data:    fiber.Map{"books": books},
+	})
+}
+
 func (h *BookHandler) HnadleUpdateBookById(c *fiber.Ctx) error {
 	req := models.BookUpdateRequest{}
 	if err := parseAndValidateReq(c, &req); err != nil {
@@ -144,8 +473,24 @@ func (h *BookHandler) HnadleUpdateBookById(c *fiber.Ctx) error {
 	book.Price = req.Price
 	book.Quantity = req.Quantity
 	book.Discount = req.Discount
+	if req.WeightGrams != 0 {
+		book.WeightGrams = req.WeightGrams
+	}
+	if req.AuthorIds != nil {
+		if book.Authors, err = h.getBookAuthors(req.AuthorIds); err != nil {
+			return err
+		}
+	}
+	if req.Isbn != "" {
+		if err := h.setBookIsbn(book, req.Isbn); err != nil {
+			return err
+		}
+	}
 
 	if err := h.db.UpdateBook(book); err != nil {
+		if errors.Is(err, database.ErrIsbnConflict) {
+			return utils.ConflictError(fmt.Sprintf("book with isbn %s already exists", *book.Isbn13))
+		}
 		return utils.InternalServerError(err)
 	}
 
@@ -1,7 +1,9 @@
 package handlers
 
 import (
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/assaidy/bookstore/internals/database"
 	"github.com/assaidy/bookstore/internals/models"
@@ -9,6 +11,10 @@ import (
 	"github.com/gofiber/fiber/v2"
 )
 
+// how long books in a cart stay reserved for the user. adding the same book
+// again extends the reservation.
+const cartReservationTTL = time.Minute * 30
+
 type CartHandler struct {
 	db *database.DBService
 }
@@ -25,25 +31,16 @@ func (h *CartHandler) HandleAddToCart(c *fiber.Ctx) error {
 		return err
 	}
 
-	book, err := h.db.GetBookById(req.BookId)
-	if err != nil {
-		return err
-	}
-	if book == nil {
-		return utils.NotFoundError(fmt.Sprintf("book with id %d not found", req.BookId))
-	}
-
-	if book.Quantity < req.Quantity {
-		return utils.InvalidDataError("given quantity is greated than book quantity")
-	}
-
-	if err := h.db.AddBookToCart(uid, req.BookId, req.Quantity); err != nil {
-		return utils.InternalServerError(err)
-	}
-
-	book.Quantity -= req.Quantity
-	if err := h.db.UpdateBook(book); err != nil {
-		return utils.InternalServerError(err)
+	reservedUntil := time.Now().UTC().Add(cartReservationTTL)
+	if err := h.db.AddBookToCart(uid, req.BookId, req.Quantity, reservedUntil); err != nil {
+		switch {
+		case errors.Is(err, database.ErrBookNotFound):
+			return utils.NotFoundError(fmt.Sprintf("book with id %d not found", req.BookId))
+		case errors.Is(err, database.ErrInsufficientStock):
+			return utils.InvalidDataError("given quantity is greated than available book quantity")
+		default:
+			return utils.InternalServerError(err)
+		}
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(utils.ApiResponse{
@@ -68,28 +65,10 @@ func (h *CartHandler) HandleDeleteBookFromCart(c *fiber.Ctx) error {
 	uid, _ := c.ParamsInt("uid")
 	bid, _ := c.ParamsInt("bid")
 
-    cartBook, err := h.db.GetBookFromCart(uid, bid)
-	if err != nil {
-		return err
-	}
-	if cartBook == nil {
-		return utils.NotFoundError(fmt.Sprintf("book with id %d not found in cart", bid))
-	}
-
-    if err := h.db.DeleteBookFromCart(uid, bid); err != nil {
-        return err
-    }
-
-    book, err := h.db.GetBookById(bid)
-    if err != nil {
-        return err
-    }
-    if book == nil {
-        return utils.NotFoundError(fmt.Sprintf("book with id %d not found", bid))
-    }
-
-	book.Quantity += cartBook.Quantity
-	if err := h.db.UpdateBook(book); err != nil {
+	if err := h.db.DeleteBookFromCart(uid, bid); err != nil {
+		if errors.Is(err, database.ErrBookNotInCart) {
+			return utils.NotFoundError(fmt.Sprintf("book with id %d not found in cart", bid))
+		}
 		return utils.InternalServerError(err)
 	}
 
@@ -1,7 +1,9 @@
 package handlers
 
 import (
+	"errors"
 	"fmt"
+	"strconv"
 	"strings"
 
 	"github.com/assaidy/bookstore/internals/database"
@@ -19,7 +21,7 @@ func NewCategoryHandler(db *database.DBService) *CategoryHandler {
 }
 
 func (h *CategoryHandler) HandleCreateCategory(c *fiber.Ctx) error {
-	req := models.CategoryCreateOrUpdateReq{}
+	req := models.CategoryCreateReq{}
 	if err := parseAndValidateReq(c, &req); err != nil {
 		return err
 	}
@@ -31,7 +33,15 @@ func (h *CategoryHandler) HandleCreateCategory(c *fiber.Ctx) error {
 		return utils.ConflictError(fmt.Sprintf("category %s already exists", req.Name))
 	}
 
-	cat := models.Category{Name: req.Name}
+	if req.ParentId != nil {
+		if ok, err := h.db.CheckIfCategoryExists(*req.ParentId); err != nil {
+			return utils.InternalServerError(err)
+		} else if !ok {
+			return utils.InvalidDataError(fmt.Sprintf("parent category with id %d not found", *req.ParentId))
+		}
+	}
+
+	cat := models.Category{Name: req.Name, ParentId: req.ParentId}
 	if err := h.db.CreateCategory(&cat); err != nil {
 		return utils.InternalServerError(err)
 	}
@@ -54,20 +64,79 @@ func (h *CategoryHandler) HandleGetAllCategories(c *fiber.Ctx) error {
 	})
 }
 
-func (h *CategoryHandler) HandleGetAllBooksByCategory(c *fiber.Ctx) error {
-	id, _ := c.ParamsInt("id") // category id
-
-	books, err := h.db.GetAllBooksByCategory(id)
+// HandleGetCategoryTree returns all categories nested under their parents.
+func (h *CategoryHandler) HandleGetCategoryTree(c *fiber.Ctx) error {
+	cats, err := h.db.GetAllCategories()
 	if err != nil {
 		return utils.InternalServerError(err)
 	}
 
+	nodes := make(map[int]*models.CategoryNode, len(cats))
+	for _, cat := range cats {
+		nodes[cat.Id] = &models.CategoryNode{Id: cat.Id, Name: cat.Name, Children: make([]*models.CategoryNode, 0)}
+	}
+	roots := make([]*models.CategoryNode, 0)
+	for _, cat := range cats {
+		node := nodes[cat.Id]
+		if cat.ParentId == nil {
+			roots = append(roots, node)
+			continue
+		}
+		parent := nodes[*cat.ParentId]
+		parent.Children = append(parent.Children, node)
+	}
+
 	return c.Status(fiber.StatusOK).JSON(utils.ApiResponse{
 		Message: "retrieved successfully",
-		Data:    fiber.Map{"books": books},
+		Data:    fiber.Map{"categories": roots},
 	})
 }
 
+// HandleGetAllBooksByCategory lists the category's books like GET /book, with
+// 'sorting' defaulting to latest. with descendants=true books in its
+// subcategories are included too.
+func (h *CategoryHandler) HandleGetAllBooksByCategory(c *fiber.Ctx) error {
+	id, _ := c.ParamsInt("id") // category id
+
+	if ok, err := h.db.CheckIfCategoryExists(id); err != nil {
+		return utils.InternalServerError(err)
+	} else if !ok {
+		return utils.NotFoundError(fmt.Sprintf("category with id %d not found", id))
+	}
+
+	descendants := false
+	if v := c.Query("descendants"); v != "" {
+		var err error
+		if descendants, err = strconv.ParseBool(v); err != nil {
+			return utils.BadRequestError("'descendants' param takes only values {true, false}")
+		}
+	}
+
+	sorting := "latest"
+	if c.Query("sorting") != "" {
+		var err error
+		if sorting, err = getSortingTechnique(c); err != nil {
+			return utils.BadRequestError(err.Error())
+		}
+	}
+	filter, err := getBookFilter(c)
+	if err != nil {
+		return utils.BadRequestError(err.Error())
+	}
+	if len(filter.CategoryIds) > 0 {
+		return utils.BadRequestError("'category' param isn't allowed here, the category comes from the path")
+	}
+	// a scope rather than a category filter, so facets stay inside it too
+	filter.ScopeCategoryIds = []int{id}
+	if descendants {
+		if filter.ScopeCategoryIds, err = h.db.GetCategoryDescendantIds(id); err != nil {
+			return utils.InternalServerError(err)
+		}
+	}
+
+	return listBooks(c, h.db, sorting, filter)
+}
+
 func (h *CategoryHandler) HandleUpdateCategoryById(c *fiber.Ctx) error {
 	req := models.CategoryCreateOrUpdateReq{}
 	if err := parseAndValidateReq(c, &req); err != nil {
@@ -79,6 +148,7 @@ func (h *CategoryHandler) HandleUpdateCategoryById(c *fiber.Ctx) error {
 
 	cat, err := h.db.GetCategoryById(id)
 	if err != nil {
+		return utils.InternalServerError(err)
 	}
 	if cat == nil {
 		return utils.NotFoundError(fmt.Sprintf("category with id %d not found", id))
@@ -103,6 +173,46 @@ func (h *CategoryHandler) HandleUpdateCategoryById(c *fiber.Ctx) error {
 	})
 }
 
+// HandleMoveCategory puts the category under another parent, or at the top
+// level when parentId is null.
+func (h *CategoryHandler) HandleMoveCategory(c *fiber.Ctx) error {
+	req := models.CategoryMoveReq{}
+	if err := parseAndValidateReq(c, &req); err != nil {
+		return err
+	}
+
+	id, _ := c.ParamsInt("id")
+
+	if ok, err := h.db.CheckIfCategoryExists(id); err != nil {
+		return utils.InternalServerError(err)
+	} else if !ok {
+		return utils.NotFoundError(fmt.Sprintf("category with id %d not found", id))
+	}
+
+	if err := h.db.MoveCategory(id, req.ParentId); err != nil {
+		switch {
+		case errors.Is(err, database.ErrCategoryNotFound):
+			return utils.NotFoundError(fmt.Sprintf("category with id %d not found", id))
+		case errors.Is(err, database.ErrParentCategoryNotFound):
+			return utils.InvalidDataError(err.Error())
+		case errors.Is(err, database.ErrCategoryCycle):
+			return utils.ConflictError(err.Error())
+		default:
+			return utils.InternalServerError(err)
+		}
+	}
+
+	cat, err := h.db.GetCategoryById(id)
+	if err != nil {
+		return utils.InternalServerError(err)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(utils.ApiResponse{
+		Message: "moved successfully",
+		Data:    fiber.Map{"category": cat},
+	})
+}
+
 func (h *CategoryHandler) HandleDeleteCategoryById(c *fiber.Ctx) error {
 	id, _ := c.ParamsInt("id")
 
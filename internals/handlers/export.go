@@ -0,0 +1,215 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/assaidy/bookstore/internals/database"
+	"github.com/assaidy/bookstore/internals/models"
+	"github.com/assaidy/bookstore/internals/utils"
+	"github.com/gofiber/fiber/v2"
+)
+
+// an export runs after the handler returned, so it gets its own deadline
+const exportTimeout = 10 * time.Minute
+
+type ExportHandler struct {
+	db *database.DBService
+}
+
+func NewExportHandler(db *database.DBService) *ExportHandler {
+	return &ExportHandler{db: db}
+}
+
+// exportWriter writes exported records as csv rows or json lines.
+type exportWriter struct {
+	csv  *csv.Writer
+	json *json.Encoder
+}
+
+// write writes v as a json line, or its records as csv rows.
+func (w *exportWriter) write(v any, records ...[]string) error {
+	if w.json != nil {
+		return w.json.Encode(v)
+	}
+	for _, record := range records {
+		for i, cell := range record {
+			record[i] = escapeFormula(cell)
+		}
+	}
+	return w.csv.WriteAll(records)
+}
+
+// escapeFormula prefixes cells that spreadsheets would run as formulas with
+// a quote, so they are shown as text.
+func escapeFormula(cell string) string {
+	if cell != "" && strings.ContainsRune("=+-@\t\r", rune(cell[0])) {
+		return "'" + cell
+	}
+	return cell
+}
+
+// streamExport responds with an attachment streamed from export as it reads
+// the database. once streaming has started the status can't change, so
+// failures are logged and cut the file short.
+func streamExport(c *fiber.Ctx, name string, header []string, export func(ctx context.Context, w *exportWriter) error) error {
+	format := c.Query("format", "csv")
+	if format != "csv" && format != "jsonl" {
+		return utils.BadRequestError("'format' param takes only values {csv, jsonl}")
+	}
+
+	if format == "csv" {
+		c.Set(fiber.HeaderContentType, "text/csv; charset=utf-8")
+	} else {
+		c.Set(fiber.HeaderContentType, "application/jsonl; charset=utf-8")
+	}
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf(
+		`attachment; filename="%s-%s.%s"`, name, time.Now().UTC().Format("20060102T150405Z"), format))
+
+	c.Context().SetBodyStreamWriter(func(bw *bufio.Writer) {
+		ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+		defer cancel()
+
+		w := exportWriter{}
+		if format == "csv" {
+			w.csv = csv.NewWriter(bw)
+			w.csv.Write(header)
+		} else {
+			w.json = json.NewEncoder(bw)
+		}
+
+		err := export(ctx, &w)
+		if w.csv != nil {
+			w.csv.Flush()
+			if err == nil {
+				err = w.csv.Error()
+			}
+		}
+		if err == nil {
+			err = bw.Flush()
+		}
+		if err != nil {
+			log.Printf("failed to export %s: %v", name, err)
+		}
+	})
+	return nil
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func (h *ExportHandler) HandleExportBooks(c *fiber.Ctx) error {
+	header := []string{
+		"id", "title", "description", "categoryId", "coverId", "price", "quantity", "availableQuantity",
+		"discount", "weightGrams", "isbn10", "isbn13", "addedAt", "purchaseCount", "authors",
+	}
+	return streamExport(c, "books", header, func(ctx context.Context, w *exportWriter) error {
+		return h.db.ExportBooks(ctx, func(b *models.Book) error {
+			var isbn10, isbn13 string
+			if b.Isbn10 != nil {
+				isbn10 = *b.Isbn10
+			}
+			if b.Isbn13 != nil {
+				isbn13 = *b.Isbn13
+			}
+			authors := ""
+			for i, a := range b.Authors {
+				if i > 0 {
+					authors += "; "
+				}
+				authors += a.Name
+			}
+			return w.write(b, []string{
+				strconv.Itoa(b.Id),
+				b.Title,
+				b.Description,
+				strconv.Itoa(b.CategoryId),
+				strconv.Itoa(b.CoverId),
+				formatFloat(b.Price),
+				strconv.Itoa(b.Quantity),
+				strconv.Itoa(b.AvailableQuantity),
+				formatFloat(b.Discount),
+				strconv.Itoa(b.WeightGrams),
+				isbn10,
+				isbn13,
+				formatTime(&b.AddedAt),
+				strconv.Itoa(b.PurchaseCount),
+				authors,
+			})
+		})
+	})
+}
+
+// HandleExportOrders exports orders with their books. csv files have a row
+// per order book, repeating the order columns; orders without books get a
+// single row with empty book columns.
+func (h *ExportHandler) HandleExportOrders(c *fiber.Ctx) error {
+	header := []string{
+		"orderId", "userId", "appliedAt", "status", "totalPrice", "shippingService", "shippingCost",
+		"trackingNumber", "bookId", "quantity", "pricePerUnit",
+	}
+	return streamExport(c, "orders", header, func(ctx context.Context, w *exportWriter) error {
+		return h.db.ExportOrders(ctx, func(o *models.Order) error {
+			var tracking string
+			if o.TrackingNumber != nil {
+				tracking = *o.TrackingNumber
+			}
+			order := []string{
+				strconv.Itoa(o.Id),
+				strconv.Itoa(o.UserId),
+				formatTime(&o.AppliedAt),
+				o.Status,
+				formatFloat(o.TotalPrice),
+				o.ShippingService,
+				formatFloat(o.ShippingCost),
+				tracking,
+			}
+
+			if len(o.OrderBooks) == 0 {
+				return w.write(o, append(order, "", "", ""))
+			}
+			records := make([][]string, 0, len(o.OrderBooks))
+			for _, ob := range o.OrderBooks {
+				records = append(records, append(order[:len(order):len(order)],
+					strconv.Itoa(ob.BookId),
+					strconv.Itoa(ob.Quantity),
+					formatFloat(ob.PricePerUnite),
+				))
+			}
+			return w.write(o, records...)
+		})
+	})
+}
+
+func (h *ExportHandler) HandleExportUsers(c *fiber.Ctx) error {
+	header := []string{"id", "name", "username", "email", "address", "role", "joinedAt", "verifiedAt"}
+	return streamExport(c, "users", header, func(ctx context.Context, w *exportWriter) error {
+		return h.db.ExportUsers(ctx, func(u *models.User) error {
+			return w.write(u, []string{
+				strconv.Itoa(u.Id),
+				u.Name,
+				u.Username,
+				u.Email,
+				u.Address,
+				u.Role,
+				formatTime(&u.JoinedAt),
+				formatTime(u.VerifiedAt),
+			})
+		})
+	})
+}
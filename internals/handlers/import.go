@@ -0,0 +1,509 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/assaidy/bookstore/internals/database"
+	"github.com/assaidy/bookstore/internals/models"
+	"github.com/assaidy/bookstore/internals/utils"
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	// limits for covers given as urls
+	importCoverTimeout   = 10 * time.Second
+	importCoverMaxBytes  = 5 << 20
+	importCoverMaxUrls   = 100
+	importCoversTimeout  = time.Minute // for all the downloads of an import
+	importCoverWorkers   = 4
+	importCoverRedirects = 3
+)
+
+// importCoverBlockedPrefixes are non-public ranges that netip doesn't already
+// report as private, loopback or link-local.
+var importCoverBlockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"), // carrier-grade nat
+	netip.MustParsePrefix("64:ff9b::/96"),  // nat64, maps to ipv4 addresses
+}
+
+// checkImportCoverAddr refuses connections to loopback, private, link-local
+// (e.g. 169.254.169.254 cloud metadata) and other non-public addresses, so
+// cover urls can't reach into the store's own network. it runs on the address
+// actually dialed, after dns resolution and for every redirect.
+func checkImportCoverAddr(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	ip = ip.Unmap()
+	if !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return fmt.Errorf("cover url resolves to non-public address %s", ip)
+	}
+	for _, prefix := range importCoverBlockedPrefixes {
+		if prefix.Contains(ip) {
+			return fmt.Errorf("cover url resolves to non-public address %s", ip)
+		}
+	}
+	return nil
+}
+
+type ImportHandler struct {
+	db     *database.DBService
+	client *http.Client
+}
+
+func NewImportHandler(db *database.DBService) *ImportHandler {
+	dialer := &net.Dialer{Timeout: importCoverTimeout, Control: checkImportCoverAddr}
+	return &ImportHandler{
+		db: db,
+		client: &http.Client{
+			Timeout: importCoverTimeout,
+			// no proxy, the dialed address must be the cover's host
+			Transport: &http.Transport{
+				DialContext:         dialer.DialContext,
+				TLSHandshakeTimeout: importCoverTimeout,
+			},
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) > importCoverRedirects {
+					return fmt.Errorf("more than %d redirects", importCoverRedirects)
+				}
+				return nil
+			},
+		},
+	}
+}
+
+// HandleImportBooks creates books from a CSV or JSON Lines body. every row is
+// checked first, and the books are only inserted, all in one transaction, if
+// none of the rows has errors. cover urls are only downloaded once every row
+// is valid otherwise. with dryRun=true nothing is downloaded or inserted.
+func (h *ImportHandler) HandleImportBooks(c *fiber.Ctx) error {
+	format, err := getImportFormat(c)
+	if err != nil {
+		return utils.BadRequestError(err.Error())
+	}
+	dryRun := false
+	if v := c.Query("dryRun"); v != "" {
+		if dryRun, err = strconv.ParseBool(v); err != nil {
+			return utils.BadRequestError("'dryRun' param takes only values {true, false}")
+		}
+	}
+
+	var (
+		rows    []*models.BookImportRow
+		rowErrs map[int]map[string]string
+	)
+	switch format {
+	case "csv":
+		rows, rowErrs, err = parseCSVImport(c.Body())
+	case "jsonl":
+		rows, rowErrs = parseJSONLImport(c.Body())
+	}
+	if err != nil {
+		return utils.BadRequestError(err.Error())
+	}
+	if len(rows) == 0 {
+		return utils.BadRequestError("import file has no rows")
+	}
+
+	cats, err := h.db.GetAllCategories()
+	if err != nil {
+		return utils.InternalServerError(err)
+	}
+	catIds := make(map[string]int, len(cats))
+	for _, cat := range cats {
+		catIds[cat.Name] = cat.Id
+	}
+
+	books := make([]*models.Book, len(rows))
+	covers := make([]*models.Cover, len(rows))
+	coverUrls := make(map[int]string) // row index -> cover url, downloaded last
+	isbnRows := make(map[string]int)  // isbn13 -> index of the first row with it
+	now := time.Now().UTC()
+
+	for i, row := range rows {
+		if rowErrs[i] != nil {
+			continue
+		}
+		if errs := utils.ValidateRequest(row); errs != nil {
+			rowErrs[i] = errs
+			continue
+		}
+
+		errs := make(map[string]string)
+		book := models.Book{
+			Title:       strings.TrimSpace(row.Title),
+			Description: strings.TrimSpace(row.Description),
+			Price:       row.Price,
+			Quantity:    row.Quantity,
+			Discount:    row.Discount,
+			WeightGrams: row.WeightGrams,
+			AddedAt:     now,
+		}
+		if book.WeightGrams == 0 {
+			book.WeightGrams = defaultBookWeightGrams
+		}
+
+		// category names are stored the way CategoryHandler normalizes them
+		catName := strings.TrimSpace(strings.ToLower(row.Category))
+		if id, ok := catIds[catName]; ok {
+			book.CategoryId = id
+		} else {
+			errs["Category"] = fmt.Sprintf("category %s not found", catName)
+		}
+
+		if row.Isbn != "" {
+			isbn13, _ := utils.NormalizeISBN(row.Isbn) // already validated
+			if first, ok := isbnRows[isbn13]; ok {
+				errs["Isbn"] = fmt.Sprintf("isbn %s is already used by row %d", isbn13, first+1)
+			} else {
+				isbnRows[isbn13] = i
+			}
+			book.Isbn13 = &isbn13
+			if isbn10, ok := utils.ISBN13To10(isbn13); ok {
+				book.Isbn10 = &isbn10
+			}
+		}
+
+		switch {
+		case row.Cover == "":
+		case isImportCoverUrl(row.Cover):
+			if err := checkImportCoverUrl(row.Cover); err != nil {
+				errs["Cover"] = err.Error()
+			} else if len(coverUrls) == importCoverMaxUrls {
+				errs["Cover"] = fmt.Sprintf("at most %d covers can be given as urls per import", importCoverMaxUrls)
+			} else {
+				coverUrls[i] = row.Cover
+			}
+		default:
+			cov, err := readImportCover(row.Cover)
+			if err != nil {
+				errs["Cover"] = err.Error()
+			}
+			covers[i] = cov
+		}
+
+		if len(errs) > 0 {
+			rowErrs[i] = errs
+			continue
+		}
+		books[i] = &book
+	}
+
+	if len(isbnRows) > 0 {
+		isbns := make([]string, 0, len(isbnRows))
+		for isbn := range isbnRows {
+			isbns = append(isbns, isbn)
+		}
+		existing, err := h.db.GetExistingIsbns(isbns)
+		if err != nil {
+			return utils.InternalServerError(err)
+		}
+		for isbn := range existing {
+			i := isbnRows[isbn]
+			if rowErrs[i] == nil {
+				rowErrs[i] = make(map[string]string)
+			}
+			rowErrs[i]["Isbn"] = fmt.Sprintf("book with isbn %s already exists", isbn)
+		}
+	}
+
+	if len(rowErrs) == 0 && !dryRun && len(coverUrls) > 0 {
+		for i, err := range h.downloadImportCovers(c.UserContext(), coverUrls, covers) {
+			rowErrs[i] = map[string]string{"Cover": err.Error()}
+		}
+	}
+
+	report := models.BookImportReport{
+		DryRun: dryRun,
+		Rows:   len(rows),
+		Errors: make([]*models.BookImportRowError, 0, len(rowErrs)),
+	}
+	for i := range rows {
+		if errs := rowErrs[i]; errs != nil {
+			report.Errors = append(report.Errors, &models.BookImportRowError{Row: i + 1, Errors: errs})
+		}
+	}
+	if len(report.Errors) > 0 {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(utils.ApiResponse{
+			Message: "some rows are invalid, nothing was imported",
+			Data:    fiber.Map{"report": report},
+		})
+	}
+
+	if dryRun {
+		return c.Status(fiber.StatusOK).JSON(utils.ApiResponse{
+			Message: "all rows are valid, nothing was imported (dry run)",
+			Data:    fiber.Map{"report": report},
+		})
+	}
+
+	if err := h.db.ImportBooks(books, covers); err != nil {
+		if errors.Is(err, database.ErrIsbnConflict) {
+			return utils.ConflictError("a book with one of the isbns was created during the import, nothing was imported")
+		}
+		return utils.InternalServerError(err)
+	}
+	report.Imported = len(books)
+
+	return c.Status(fiber.StatusCreated).JSON(utils.ApiResponse{
+		Message: "imported successfully",
+		Data:    fiber.Map{"report": report},
+	})
+}
+
+// getImportFormat reads the 'format' param, falling back to the Content-Type.
+func getImportFormat(c *fiber.Ctx) (string, error) {
+	format := c.Query("format")
+	if format == "" {
+		ct := strings.ToLower(c.Get(fiber.HeaderContentType))
+		switch {
+		case strings.HasPrefix(ct, "text/csv"):
+			format = "csv"
+		case strings.HasPrefix(ct, "application/jsonl"),
+			strings.HasPrefix(ct, "application/x-ndjson"),
+			strings.HasPrefix(ct, "application/x-jsonlines"):
+			format = "jsonl"
+		}
+	}
+	if format != "csv" && format != "jsonl" {
+		return "", fmt.Errorf("'format' param takes only values {csv, jsonl}, or set Content-Type to text/csv or application/jsonl")
+	}
+	return format, nil
+}
+
+// importFields sets the row fields from csv columns, named as in the json
+// form. header names are matched ignoring case.
+var importFields = map[string]func(row *models.BookImportRow, v string) error{
+	"title":       func(row *models.BookImportRow, v string) error { row.Title = v; return nil },
+	"description": func(row *models.BookImportRow, v string) error { row.Description = v; return nil },
+	"category":    func(row *models.BookImportRow, v string) error { row.Category = v; return nil },
+	"isbn":        func(row *models.BookImportRow, v string) error { row.Isbn = v; return nil },
+	"cover":       func(row *models.BookImportRow, v string) error { row.Cover = v; return nil },
+	"price": func(row *models.BookImportRow, v string) (err error) {
+		row.Price, err = strconv.ParseFloat(v, 64)
+		return
+	},
+	"quantity": func(row *models.BookImportRow, v string) (err error) {
+		row.Quantity, err = strconv.Atoi(v)
+		return
+	},
+	"discount": func(row *models.BookImportRow, v string) (err error) {
+		row.Discount, err = strconv.ParseFloat(v, 64)
+		return
+	},
+	"weightGrams": func(row *models.BookImportRow, v string) (err error) {
+		row.WeightGrams, err = strconv.Atoi(v)
+		return
+	},
+}
+
+// parseCSVImport reads the rows of a csv file whose header names the columns.
+// rows that can't be read are reported in rowErrs by index; an error means
+// the file itself is unusable.
+func parseCSVImport(body []byte) (rows []*models.BookImportRow, rowErrs map[int]map[string]string, err error) {
+	r := csv.NewReader(bytes.NewReader(body))
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+
+	header, err := r.Read()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, nil, nil
+		}
+		return nil, nil, fmt.Errorf("invalid csv header: %s", err)
+	}
+	for i, name := range header {
+		header[i] = ""
+		for field := range importFields {
+			if strings.EqualFold(strings.TrimSpace(name), field) {
+				header[i] = field
+			}
+		}
+		if header[i] == "" {
+			return nil, nil, fmt.Errorf("unknown csv column '%s'", name)
+		}
+	}
+
+	rowErrs = make(map[int]map[string]string)
+	for {
+		record, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid csv: %s", err)
+		}
+
+		i := len(rows)
+		row := models.BookImportRow{}
+		rows = append(rows, &row)
+		if len(record) != len(header) {
+			rowErrs[i] = map[string]string{"row": fmt.Sprintf("has %d fields, the header has %d", len(record), len(header))}
+			continue
+		}
+		for j, v := range record {
+			v = strings.TrimSpace(v)
+			if v == "" {
+				continue
+			}
+			if err := importFields[header[j]](&row, v); err != nil {
+				if rowErrs[i] == nil {
+					rowErrs[i] = make(map[string]string)
+				}
+				// keyed by struct field like the validation errors
+				rowErrs[i][strings.ToUpper(header[j][:1])+header[j][1:]] = fmt.Sprintf("'%s' is not a number", v)
+			}
+		}
+	}
+
+	return rows, rowErrs, nil
+}
+
+// parseJSONLImport reads one json object per line, skipping blank lines.
+// lines that can't be read are reported in rowErrs by index.
+func parseJSONLImport(body []byte) (rows []*models.BookImportRow, rowErrs map[int]map[string]string) {
+	rowErrs = make(map[int]map[string]string)
+	for _, line := range bytes.Split(body, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+
+		i := len(rows)
+		row := models.BookImportRow{}
+		rows = append(rows, &row)
+		dec := json.NewDecoder(bytes.NewReader(line))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&row); err != nil {
+			rowErrs[i] = map[string]string{"row": fmt.Sprintf("invalid json: %s", err)}
+		}
+	}
+	return rows, rowErrs
+}
+
+func isImportCoverUrl(src string) bool {
+	return strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://")
+}
+
+func checkImportCoverUrl(src string) error {
+	u, err := url.Parse(src)
+	if err != nil || u.Hostname() == "" {
+		return fmt.Errorf("invalid cover url")
+	}
+	return nil
+}
+
+// downloadImportCovers downloads the covers given as urls into covers, by
+// row index, a few at a time and within importCoversTimeout overall. the
+// returned errors are by row index too.
+func (h *ImportHandler) downloadImportCovers(ctx context.Context, urls map[int]string, covers []*models.Cover) map[int]error {
+	ctx, cancel := context.WithTimeout(ctx, importCoversTimeout)
+	defer cancel()
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs = make(map[int]error)
+		sem  = make(chan struct{}, importCoverWorkers)
+	)
+	for i, src := range urls {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			cov, err := h.downloadImportCover(ctx, src)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			covers[i] = cov
+		}()
+	}
+	wg.Wait()
+	return errs
+}
+
+// downloadImportCover reads a cover given as an http(s) url.
+func (h *ImportHandler) downloadImportCover(ctx context.Context, src string) (*models.Cover, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("cover downloads took longer than %s", importCoversTimeout)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, src, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cover url")
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download cover: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download cover: %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, importCoverMaxBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to download cover: %s", err)
+	}
+	if len(data) > importCoverMaxBytes {
+		return nil, fmt.Errorf("cover is larger than %d MB", importCoverMaxBytes>>20)
+	}
+	return newImportCover(data)
+}
+
+// readImportCover reads a cover given as a data url or plain base64 content.
+func readImportCover(src string) (*models.Cover, error) {
+	if strings.HasPrefix(src, "data:") {
+		_, content, ok := strings.Cut(src, ";base64,")
+		if !ok {
+			return nil, fmt.Errorf("cover data url must be base64 encoded")
+		}
+		src = content
+	}
+	data, err := base64.StdEncoding.DecodeString(src)
+	if err != nil {
+		return nil, fmt.Errorf("cover is neither a url nor base64 content")
+	}
+	return newImportCover(data)
+}
+
+// newImportCover makes a cover of the image. only png and jpeg images are
+// accepted.
+func newImportCover(data []byte) (*models.Cover, error) {
+	cov := models.Cover{
+		Encoding: http.DetectContentType(data),
+		Content:  base64.StdEncoding.EncodeToString(data),
+	}
+	if cov.Encoding != "image/png" && cov.Encoding != "image/jpeg" {
+		return nil, fmt.Errorf("cover must be a png or jpeg image")
+	}
+	if !utils.CheckEncodingMatchesContent(cov.Encoding, cov.Content) {
+		return nil, fmt.Errorf("cover is not a valid %s image", cov.Encoding)
+	}
+	return &cov, nil
+}
@@ -1,44 +1,178 @@
 package handlers
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"log"
 
 	"github.com/assaidy/bookstore/internals/database"
+	"github.com/assaidy/bookstore/internals/models"
+	"github.com/assaidy/bookstore/internals/payment"
+	"github.com/assaidy/bookstore/internals/shipping"
 	"github.com/assaidy/bookstore/internals/utils"
 	"github.com/gofiber/fiber/v2"
 )
 
+// used when checkout doesn't ask for a shipping service
+const defaultShippingService = "standard"
+
 type OrderHandler struct {
-	db *database.DBService
+	db                   *database.DBService
+	payments             payment.PaymentProvider
+	shipper              shipping.ShippingProvider
+	requireVerifiedEmail bool
 }
 
-func NewOrderHandler(db *database.DBService) *OrderHandler {
-	return &OrderHandler{db: db}
+func NewOrderHandler(
+	db *database.DBService,
+	payments payment.PaymentProvider,
+	shipper shipping.ShippingProvider,
+	requireVerifiedEmail bool,
+) *OrderHandler {
+	return &OrderHandler{
+		db:                   db,
+		payments:             payments,
+		shipper:              shipper,
+		requireVerifiedEmail: requireVerifiedEmail,
+	}
 }
 
 func (h *OrderHandler) HandleApplyOrder(c *fiber.Ctx) error {
-	// TODO: handle third party shipment
-	// TODO: handle third party payment
+	req := models.OrderApplyReq{}
+	if err := parseAndValidateReq(c, &req); err != nil {
+		return err
+	}
+	if req.ShippingService == "" {
+		req.ShippingService = defaultShippingService
+	}
 
 	uid, _ := c.ParamsInt("uid")
 
-	if ok, err := h.db.CheckIfUserExists(uid); err != nil {
+	user, err := h.db.GetUserById(uid)
+	if err != nil {
 		return utils.InternalServerError(err)
-	} else if !ok {
+	}
+	if user == nil {
 		return utils.NotFoundError(fmt.Sprintf("user with id %d not found", uid))
 	}
 
-	if err := h.db.MakeOrder(uid); err != nil {
+	if h.requireVerifiedEmail {
+		if ok, err := h.db.CheckIfUserVerified(uid); err != nil {
+			return utils.InternalServerError(err)
+		} else if !ok {
+			return utils.ForbiddenError("email must be verified before placing an order")
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(c.UserContext(), paymentTimeout)
+	defer cancel()
+
+	weight, err := h.db.GetCartWeight(uid)
+	if err != nil {
+		return utils.InternalServerError(err)
+	}
+	rate, err := shipping.QuoteService(ctx, h.shipper, shipping.QuoteRequest{
+		Address:     user.Address,
+		WeightGrams: weight,
+	}, req.ShippingService)
+	if err != nil {
+		if errors.Is(err, shipping.ErrUnknownService) || errors.Is(err, shipping.ErrUnserviceableAddress) {
+			return utils.InvalidDataError(err.Error())
+		}
 		return utils.InternalServerError(err)
 	}
 
-	return c.Status(fiber.StatusOK).JSON(utils.ApiResponse{
-		Message: "ordered successfully",
-	})
+	orderId, err := h.db.MakeOrder(uid, weight, rate.Service, rate.Cost)
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrEmptyCart):
+			return utils.InvalidDataError("cart is empty")
+		case errors.Is(err, database.ErrInsufficientStock):
+			return utils.InvalidDataError(err.Error())
+		case errors.Is(err, database.ErrCartChanged):
+			return utils.ConflictError("cart changed during checkout, check the shipping rates and try again")
+		}
+		return utils.InternalServerError(err)
+	}
+
+	// the order is placed by now, so nothing from here on may look like a
+	// failed checkout: a retry would place it again. it stays pending_payment
+	// until the gateway's webhook settles it.
+	order, err := h.db.GetOrderById(orderId)
+	if err != nil || order == nil {
+		log.Printf("failed to load order %d to charge it: %v", orderId, err)
+		return c.Status(fiber.StatusAccepted).JSON(utils.ApiResponse{
+			Message: "order placed, payment is being processed",
+			Data:    fiber.Map{"orderId": orderId},
+		})
+	}
+
+	p, err := chargeOrder(ctx, h.db, h.payments, order, req.PaymentMethod)
+	if err != nil {
+		log.Printf("failed to charge order %d: %v", orderId, err)
+		return c.Status(fiber.StatusAccepted).JSON(utils.ApiResponse{
+			Message: "order placed, payment is being processed",
+			Data:    fiber.Map{"orderId": orderId},
+		})
+	}
+
+	switch p.Status {
+	case models.PaymentStatusCaptured:
+		return c.Status(fiber.StatusOK).JSON(utils.ApiResponse{
+			Message: "ordered successfully",
+			Data:    fiber.Map{"orderId": orderId},
+		})
+	case models.PaymentStatusDeclined:
+		return utils.PaymentRequiredError("payment declined, the order was cancelled")
+	default:
+		return c.Status(fiber.StatusAccepted).JSON(utils.ApiResponse{
+			Message: "order placed, payment is being processed",
+			Data:    fiber.Map{"orderId": orderId},
+		})
+	}
+}
+
+// getOrderPaging reads the paging params of order listings: 'page' and
+// 'limit' like book listings, or a 'cursor' taking the place of 'page'.
+func getOrderPaging(c *fiber.Ctx) (*models.OrderCursor, int, int, error) {
+	var after *models.OrderCursor
+	if v := c.Query("cursor"); v != "" {
+		after = &models.OrderCursor{}
+		if err := utils.DecodeCursor(v, after); err != nil {
+			return nil, 0, 0, fmt.Errorf("'cursor' param is invalid")
+		}
+	}
+	page, limit := getPaginationData(c)
+	return after, page, limit, nil
+}
+
+// orderPageData is the response data of order listings. nextCursor is set
+// when the page is full, as more orders may follow.
+func orderPageData(orders []*models.Order, page, limit, totalOrders int) (fiber.Map, error) {
+	var nextCursor *string
+	if len(orders) == limit {
+		cursor, err := utils.EncodeCursor(models.NewOrderCursor(orders[len(orders)-1]))
+		if err != nil {
+			return nil, err
+		}
+		nextCursor = &cursor
+	}
+	return fiber.Map{
+		"orders":     orders,
+		"page":       page,
+		"limit":      limit,
+		"totalPages": (totalOrders + limit - 1) / limit,
+		"nextCursor": nextCursor,
+	}, nil
 }
 
 func (h *OrderHandler) HandleGetAllOrderByUser(c *fiber.Ctx) error {
 	uid, _ := c.ParamsInt("uid")
+	after, page, limit, err := getOrderPaging(c)
+	if err != nil {
+		return utils.BadRequestError(err.Error())
+	}
 
 	if ok, err := h.db.CheckIfUserExists(uid); err != nil {
 		return utils.InternalServerError(err)
@@ -46,26 +180,47 @@ func (h *OrderHandler) HandleGetAllOrderByUser(c *fiber.Ctx) error {
 		return utils.NotFoundError(fmt.Sprintf("user with id %d not found", uid))
 	}
 
-	orders, err := h.db.GetAllOrdersByUser(uid)
+	orders, err := h.db.GetAllOrdersByUser(uid, after, page, limit)
+	if err != nil {
+		return utils.InternalServerError(err)
+	}
+	totalOrders, err := h.db.GetTotalOrdersByUser(uid)
+	if err != nil {
+		return utils.InternalServerError(err)
+	}
+	data, err := orderPageData(orders, page, limit, totalOrders)
 	if err != nil {
 		return utils.InternalServerError(err)
 	}
 
 	return c.Status(fiber.StatusOK).JSON(utils.ApiResponse{
 		Message: "retrieved successfully",
-		Data:    fiber.Map{"orders": orders},
+		Data:    data,
 	})
 }
 
 func (h *OrderHandler) HandleGetAllOrders(c *fiber.Ctx) error {
-	orders, err := h.db.GetAllOrders()
+	after, page, limit, err := getOrderPaging(c)
+	if err != nil {
+		return utils.BadRequestError(err.Error())
+	}
+
+	orders, err := h.db.GetAllOrders(after, page, limit)
+	if err != nil {
+		return utils.InternalServerError(err)
+	}
+	totalOrders, err := h.db.GetTotalOrders()
+	if err != nil {
+		return utils.InternalServerError(err)
+	}
+	data, err := orderPageData(orders, page, limit, totalOrders)
 	if err != nil {
 		return utils.InternalServerError(err)
 	}
 
 	return c.Status(fiber.StatusOK).JSON(utils.ApiResponse{
 		Message: "retrieved successfully",
-		Data:    fiber.Map{"orders": orders},
+		Data:    data,
 	})
 }
 
@@ -80,9 +235,198 @@ func (h *OrderHandler) HandleGetOrderById(c *fiber.Ctx) error {
 		return utils.NotFoundError(fmt.Sprintf("order with id %d not found", id))
 	}
 
+	// only staff can see other users' orders
+	if role, _ := utils.GetUserRoleFromContext(c); role != models.RoleStaff && role != models.RoleAdmin {
+		if uid, ok := utils.GetUserIdFromContext(c); !ok || uid != order.UserId {
+			return utils.NotFoundError(fmt.Sprintf("order with id %d not found", id))
+		}
+	}
+
 	return c.Status(fiber.StatusOK).JSON(utils.ApiResponse{
 		Message: "retrieved successfully",
 		Data:    fiber.Map{"order": order},
 	})
+}
 
+func (h *OrderHandler) HandleUpdateOrderStatus(c *fiber.Ctx) error {
+	req := models.OrderStatusUpdateReq{}
+	if err := parseAndValidateReq(c, &req); err != nil {
+		return err
+	}
+
+	id, _ := c.ParamsInt("id")
+	actorId, ok := utils.GetUserIdFromContext(c)
+	if !ok {
+		return utils.UnauthorizedError()
+	}
+
+	switch req.Status {
+	case models.OrderStatusCancelled:
+		return h.cancelOrder(c, id)
+	case models.OrderStatusShipped:
+		return h.shipOrder(c, id, actorId)
+	}
+
+	if err := h.db.UpdateOrderStatus(id, req.Status, actorId); err != nil {
+		switch {
+		case errors.Is(err, database.ErrOrderNotFound):
+			return utils.NotFoundError(fmt.Sprintf("order with id %d not found", id))
+		case errors.Is(err, database.ErrInvalidStatusTransition):
+			return utils.InvalidDataError(err.Error())
+		default:
+			return utils.InternalServerError(err)
+		}
+	}
+
+	return c.Status(fiber.StatusOK).JSON(utils.ApiResponse{
+		Message: "updated successfully",
+	})
+}
+
+func (h *OrderHandler) HandleCancelOrderByUser(c *fiber.Ctx) error {
+	uid, _ := c.ParamsInt("uid")
+	id, _ := c.ParamsInt("id")
+
+	order, err := h.db.GetOrderById(id)
+	if err != nil {
+		return utils.InternalServerError(err)
+	}
+	if order == nil || order.UserId != uid {
+		return utils.NotFoundError(fmt.Sprintf("order with id %d not found", id))
+	}
+
+	return h.cancelOrder(c, id)
+}
+
+func (h *OrderHandler) HandleCancelOrder(c *fiber.Ctx) error {
+	id, _ := c.ParamsInt("id")
+	return h.cancelOrder(c, id)
+}
+
+func (h *OrderHandler) cancelOrder(c *fiber.Ctx, id int) error {
+	actorId, ok := utils.GetUserIdFromContext(c)
+	if !ok {
+		return utils.UnauthorizedError()
+	}
+
+	if err := h.db.CancelOrder(id, actorId); err != nil {
+		switch {
+		case errors.Is(err, database.ErrOrderNotFound):
+			return utils.NotFoundError(fmt.Sprintf("order with id %d not found", id))
+		case errors.Is(err, database.ErrInvalidStatusTransition):
+			return utils.InvalidDataError(err.Error())
+		default:
+			return utils.InternalServerError(err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(c.UserContext(), paymentTimeout)
+	defer cancel()
+
+	// the order is cancelled for good by now, and its payment marked to be
+	// given back. if the gateway fails, the job settling payments retries it.
+	if err := settleOrderPayment(ctx, h.db, h.payments, id); err != nil {
+		log.Printf("failed to settle payment of cancelled order %d: %v", id, err)
+		return c.Status(fiber.StatusAccepted).JSON(utils.ApiResponse{
+			Message: "cancelled successfully, the refund is being processed",
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(utils.ApiResponse{
+		Message: "cancelled successfully",
+	})
+}
+
+// shipOrder creates the shipment with the carrier, then marks the order as
+// shipped with its tracking number.
+func (h *OrderHandler) shipOrder(c *fiber.Ctx, id, actorId int) error {
+	order, err := h.db.GetOrderById(id)
+	if err != nil {
+		return utils.InternalServerError(err)
+	}
+	if order == nil {
+		return utils.NotFoundError(fmt.Sprintf("order with id %d not found", id))
+	}
+	// checked here as well so no shipment is created for an order that can't be shipped
+	if !models.CanTransitionOrderStatus(order.Status, models.OrderStatusShipped) {
+		return utils.InvalidDataError(fmt.Sprintf("cannot move order from %s to %s", order.Status, models.OrderStatusShipped))
+	}
+
+	user, err := h.db.GetUserById(order.UserId)
+	if err != nil {
+		return utils.InternalServerError(err)
+	}
+	if user == nil {
+		return utils.NotFoundError(fmt.Sprintf("user with id %d not found", order.UserId))
+	}
+	weight, err := h.db.GetOrderWeight(id)
+	if err != nil {
+		return utils.InternalServerError(err)
+	}
+
+	service := order.ShippingService
+	if service == "" {
+		service = defaultShippingService
+	}
+	shipment, err := h.shipper.CreateShipment(c.UserContext(), shipping.ShipmentRequest{
+		OrderId:     id,
+		Address:     user.Address,
+		WeightGrams: weight,
+		Service:     service,
+	})
+	if err != nil {
+		if errors.Is(err, shipping.ErrUnserviceableAddress) {
+			return utils.InvalidDataError(err.Error())
+		}
+		return utils.InternalServerError(err)
+	}
+
+	if err := h.db.ShipOrder(id, shipment.TrackingNumber, actorId); err != nil {
+		switch {
+		case errors.Is(err, database.ErrOrderNotFound):
+			return utils.NotFoundError(fmt.Sprintf("order with id %d not found", id))
+		case errors.Is(err, database.ErrInvalidStatusTransition):
+			return utils.InvalidDataError(err.Error())
+		default:
+			return utils.InternalServerError(err)
+		}
+	}
+
+	return c.Status(fiber.StatusOK).JSON(utils.ApiResponse{
+		Message: "updated successfully",
+		Data:    fiber.Map{"trackingNumber": shipment.TrackingNumber},
+	})
+}
+
+func (h *OrderHandler) HandleGetShippingRates(c *fiber.Ctx) error {
+	uid, _ := c.ParamsInt("uid")
+
+	user, err := h.db.GetUserById(uid)
+	if err != nil {
+		return utils.InternalServerError(err)
+	}
+	if user == nil {
+		return utils.NotFoundError(fmt.Sprintf("user with id %d not found", uid))
+	}
+
+	weight, err := h.db.GetCartWeight(uid)
+	if err != nil {
+		return utils.InternalServerError(err)
+	}
+
+	rates, err := h.shipper.QuoteRates(c.UserContext(), shipping.QuoteRequest{
+		Address:     user.Address,
+		WeightGrams: weight,
+	})
+	if err != nil {
+		if errors.Is(err, shipping.ErrUnserviceableAddress) {
+			return utils.InvalidDataError(err.Error())
+		}
+		return utils.InternalServerError(err)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(utils.ApiResponse{
+		Message: "retrieved successfully",
+		Data:    fiber.Map{"rates": rates, "weightGrams": weight},
+	})
 }
@@ -0,0 +1,253 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/assaidy/bookstore/internals/database"
+	"github.com/assaidy/bookstore/internals/models"
+	"github.com/assaidy/bookstore/internals/payment"
+	"github.com/assaidy/bookstore/internals/utils"
+	"github.com/gofiber/fiber/v2"
+)
+
+const paymentTimeout = time.Second * 15
+
+// unsettled payments younger than this are left to the request that
+// cancelled their order
+const settleRetryDelay = time.Minute
+
+var errNoProviderRef = errors.New("payment has no gateway reference")
+
+type PaymentHandler struct {
+	db       *database.DBService
+	payments payment.PaymentProvider
+}
+
+func NewPaymentHandler(db *database.DBService, payments payment.PaymentProvider) *PaymentHandler {
+	return &PaymentHandler{db: db, payments: payments}
+}
+
+// chargeOrder authorizes and captures the order total. a declined payment
+// cancels the order. if the gateway times out the order stays pending_payment
+// and is settled later by the gateway's webhook. the returned payment tells
+// which of these happened; errors are only returned for unexpected failures.
+func chargeOrder(ctx context.Context, db *database.DBService, payments payment.PaymentProvider, order *models.Order, paymentMethod string) (*models.Payment, error) {
+	now := time.Now().UTC()
+	p := models.Payment{
+		OrderId:   order.Id,
+		Amount:    order.TotalPrice,
+		Status:    models.PaymentStatusPending,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err := db.CreatePayment(&p); err != nil {
+		return nil, err
+	}
+
+	auth, err := payments.Authorize(ctx, payment.AuthorizeRequest{
+		OrderId:       order.Id,
+		UserId:        order.UserId,
+		Amount:        order.TotalPrice,
+		PaymentMethod: paymentMethod,
+	})
+	if err != nil {
+		return settleFailedPayment(ctx, db, payments, &p, err)
+	}
+	p.ProviderRef = &auth.Id
+	p.Status = models.PaymentStatusAuthorized
+	p.UpdatedAt = time.Now().UTC()
+	if err := db.UpdatePayment(&p); err != nil {
+		return nil, err
+	}
+
+	if err := payments.Capture(ctx, auth.Id, order.TotalPrice); err != nil {
+		return settleFailedPayment(ctx, db, payments, &p, err)
+	}
+	p.Status = models.PaymentStatusCaptured
+	p.UpdatedAt = time.Now().UTC()
+	if err := db.UpdatePayment(&p); err != nil {
+		return nil, err
+	}
+
+	if err := db.UpdateOrderStatus(order.Id, models.OrderStatusPaid, 0); err != nil {
+		if !errors.Is(err, database.ErrInvalidStatusTransition) {
+			return nil, err
+		}
+		// the order was cancelled while it was being charged
+		if err := refundLateCapture(ctx, db, payments, &p); err != nil {
+			return nil, err
+		}
+	}
+
+	return &p, nil
+}
+
+// settleFailedPayment records a payment the gateway declined or didn't answer
+// for in time. a declined payment cancels the order, and if it was already
+// authorized the authorization is voided so the funds aren't left held. a void
+// that fails is retried by SettleCancelledPayments.
+func settleFailedPayment(ctx context.Context, db *database.DBService, payments payment.PaymentProvider, p *models.Payment, err error) (*models.Payment, error) {
+	switch {
+	case errors.Is(err, payment.ErrDeclined):
+		p.Status = models.PaymentStatusDeclined
+		if p.ProviderRef != nil {
+			if err := payments.Void(ctx, *p.ProviderRef); err != nil {
+				log.Printf("failed to void authorization of declined payment of order %d: %v", p.OrderId, err)
+				p.Status = models.PaymentStatusVoidPending
+			}
+		}
+		p.UpdatedAt = time.Now().UTC()
+		if err := db.UpdatePayment(p); err != nil {
+			return nil, err
+		}
+		if err := db.CancelOrder(p.OrderId, 0); err != nil {
+			return nil, err
+		}
+		return p, nil
+	case errors.Is(err, payment.ErrTimeout), errors.Is(err, context.DeadlineExceeded):
+		return p, nil
+	default:
+		return nil, err
+	}
+}
+
+// settlePayment gives back a payment marked by CancelOrder: refund_pending
+// payments are refunded and void_pending ones voided. other payments are left
+// alone. on failure the mark stays, and SettleCancelledPayments retries it.
+// payments without a gateway reference can't be settled here and are reported
+// with errNoProviderRef, to be settled by hand.
+func settlePayment(ctx context.Context, db *database.DBService, payments payment.PaymentProvider, p *models.Payment) error {
+	if p.ProviderRef == nil &&
+		(p.Status == models.PaymentStatusRefundPending || p.Status == models.PaymentStatusVoidPending) {
+		return fmt.Errorf("payment %d: %w", p.Id, errNoProviderRef)
+	}
+
+	switch p.Status {
+	case models.PaymentStatusRefundPending:
+		if err := payments.Refund(ctx, *p.ProviderRef, p.Amount); err != nil {
+			return err
+		}
+		p.Status = models.PaymentStatusRefunded
+	case models.PaymentStatusVoidPending:
+		if err := payments.Void(ctx, *p.ProviderRef); err != nil {
+			return err
+		}
+		p.Status = models.PaymentStatusVoided
+	default:
+		return nil
+	}
+	p.UpdatedAt = time.Now().UTC()
+	return db.UpdatePayment(p)
+}
+
+// settleOrderPayment is settlePayment for the order's payment, if it has one.
+func settleOrderPayment(ctx context.Context, db *database.DBService, payments payment.PaymentProvider, oid int) error {
+	p, err := db.GetPaymentByOrderId(oid)
+	if err != nil {
+		return err
+	}
+	if p == nil {
+		return nil
+	}
+	return settlePayment(ctx, db, payments, p)
+}
+
+// refundLateCapture marks a payment captured after its order was cancelled
+// for refund, and tries the refund right away. a failed refund is only
+// logged, it's retried by SettleCancelledPayments.
+func refundLateCapture(ctx context.Context, db *database.DBService, payments payment.PaymentProvider, p *models.Payment) error {
+	p.Status = models.PaymentStatusRefundPending
+	p.UpdatedAt = time.Now().UTC()
+	if err := db.UpdatePayment(p); err != nil {
+		return err
+	}
+	if err := settlePayment(ctx, db, payments, p); err != nil {
+		log.Printf("failed to refund payment of cancelled order %d: %v", p.OrderId, err)
+	}
+	return nil
+}
+
+// SettleCancelledPayments retries the refunds and voids of cancelled orders
+// that failed when the order was cancelled.
+func (h *PaymentHandler) SettleCancelledPayments(ctx context.Context) error {
+	ps, err := h.db.GetUnsettledPayments(time.Now().UTC().Add(-settleRetryDelay))
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, p := range ps {
+		ctx, cancel := context.WithTimeout(ctx, paymentTimeout)
+		if err := settlePayment(ctx, h.db, h.payments, p); err != nil {
+			errs = append(errs, fmt.Errorf("order %d: %w", p.OrderId, err))
+		}
+		cancel()
+	}
+	return errors.Join(errs...)
+}
+
+func (h *PaymentHandler) HandlePaymentWebhook(c *fiber.Ctx) error {
+	event, err := h.payments.VerifyWebhook(c.Body(), c.Get("X-Signature"))
+	if err != nil {
+		if errors.Is(err, payment.ErrInvalidSignature) {
+			return utils.UnauthorizedError()
+		}
+		return utils.BadRequestError("invalid webhook payload")
+	}
+
+	p, err := h.db.GetPaymentByOrderId(event.OrderId)
+	if err != nil {
+		return utils.InternalServerError(err)
+	}
+	if p == nil {
+		return utils.NotFoundError(fmt.Sprintf("payment for order with id %d not found", event.OrderId))
+	}
+
+	ctx, cancel := context.WithTimeout(c.UserContext(), paymentTimeout)
+	defer cancel()
+
+	switch event.Type {
+	case payment.EventPaymentCaptured:
+		if p.Status == models.PaymentStatusCaptured ||
+			p.Status == models.PaymentStatusRefundPending ||
+			p.Status == models.PaymentStatusRefunded {
+			break
+		}
+		if event.PaymentId != "" {
+			p.ProviderRef = &event.PaymentId
+		} else if p.ProviderRef == nil {
+			// without it the capture could never be refunded
+			return utils.BadRequestError("paymentId is required to capture a payment that wasn't authorized")
+		}
+		p.Status = models.PaymentStatusCaptured
+		p.UpdatedAt = time.Now().UTC()
+		if err := h.db.UpdatePayment(p); err != nil {
+			return utils.InternalServerError(err)
+		}
+		if err := h.db.UpdateOrderStatus(p.OrderId, models.OrderStatusPaid, 0); err != nil {
+			if !errors.Is(err, database.ErrInvalidStatusTransition) {
+				return utils.InternalServerError(err)
+			}
+			// the order was cancelled while the payment was in flight
+			if err := refundLateCapture(ctx, h.db, h.payments, p); err != nil {
+				return utils.InternalServerError(err)
+			}
+		}
+	case payment.EventPaymentFailed:
+		if p.Status != models.PaymentStatusPending && p.Status != models.PaymentStatusAuthorized {
+			break
+		}
+		if _, err := settleFailedPayment(ctx, h.db, h.payments, p, payment.ErrDeclined); err != nil &&
+			!errors.Is(err, database.ErrInvalidStatusTransition) {
+			return utils.InternalServerError(err)
+		}
+	}
+
+	return c.Status(fiber.StatusOK).JSON(utils.ApiResponse{
+		Message: "processed successfully",
+	})
+}
@@ -0,0 +1,287 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/assaidy/bookstore/internals/database"
+	"github.com/assaidy/bookstore/internals/database/dbtest"
+	"github.com/assaidy/bookstore/internals/models"
+	"github.com/assaidy/bookstore/internals/payment"
+	"github.com/assaidy/bookstore/internals/utils"
+	"github.com/gofiber/fiber/v2"
+)
+
+// these tests need a real postgres, see dbtest.
+
+const testWebhookSecret = "secret"
+
+// newPaymentTest returns a database holding one user with one order waiting
+// for its payment, and a fake gateway with the given outcome.
+func newPaymentTest(t *testing.T, outcome payment.Outcome) (*database.DBService, *payment.FakeProvider, *models.Order) {
+	t.Helper()
+	db := dbtest.Open(t)
+
+	order := models.Order{TotalPrice: 20, Status: models.OrderStatusPendingPayment}
+	if err := db.QueryRow(`
+    INSERT INTO users (name, username, password, email, address)
+    VALUES ('buyer', 'buyer', 'x', 'buyer@example.com', 'somewhere')
+    RETURNING id;
+    `).Scan(&order.UserId); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow(`
+    INSERT INTO orders (user_id, total_price, status) VALUES ($1, $2, $3) RETURNING id;
+    `, order.UserId, order.TotalPrice, order.Status).Scan(&order.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	return database.NewDBServiceWithDB(db), payment.NewFakeProvider(outcome, testWebhookSecret), &order
+}
+
+func mustGetPayment(t *testing.T, dbs *database.DBService, oid int) *models.Payment {
+	t.Helper()
+	p, err := dbs.GetPaymentByOrderId(oid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p == nil {
+		t.Fatalf("order %d has no payment", oid)
+	}
+	return p
+}
+
+func checkStatuses(t *testing.T, dbs *database.DBService, oid int, paymentStatus, orderStatus string) {
+	t.Helper()
+	if p := mustGetPayment(t, dbs, oid); p.Status != paymentStatus {
+		t.Errorf("payment is %s, want %s", p.Status, paymentStatus)
+	}
+	order, err := dbs.GetOrderById(oid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if order.Status != orderStatus {
+		t.Errorf("order is %s, want %s", order.Status, orderStatus)
+	}
+}
+
+// postWebhook sends event to the webhook handler, signed by fake when sign is
+// set, and returns the response status.
+func postWebhook(t *testing.T, h *PaymentHandler, fake *payment.FakeProvider, event payment.WebhookEvent, sign bool) int {
+	t.Helper()
+	app := fiber.New(fiber.Config{
+		ErrorHandler: func(c *fiber.Ctx, err error) error {
+			var apiE utils.ApiError
+			if errors.As(err, &apiE) {
+				return c.SendStatus(apiE.Code)
+			}
+			return c.SendStatus(fiber.StatusInternalServerError)
+		},
+	})
+	app.Post("/webhook", h.HandlePaymentWebhook)
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(fiber.MethodPost, "/webhook", bytes.NewReader(payload))
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	if sign {
+		req.Header.Set("X-Signature", fake.Sign(payload))
+	}
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode
+}
+
+// captureGatewaySide has the fake gateway authorize and capture a payment on
+// its own, the way a gateway that timed out earlier would before sending its
+// webhook, and returns the payment's id.
+func captureGatewaySide(t *testing.T, fake *payment.FakeProvider, order *models.Order) string {
+	t.Helper()
+	fake.SetOutcome(payment.OutcomeSucceed)
+	auth, err := fake.Authorize(context.Background(), payment.AuthorizeRequest{OrderId: order.Id, Amount: order.TotalPrice})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.Capture(context.Background(), auth.Id, order.TotalPrice); err != nil {
+		t.Fatal(err)
+	}
+	return auth.Id
+}
+
+func TestChargeOrderSucceed(t *testing.T) {
+	dbs, fake, order := newPaymentTest(t, payment.OutcomeSucceed)
+
+	p, err := chargeOrder(context.Background(), dbs, fake, order, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Status != models.PaymentStatusCaptured || p.ProviderRef == nil {
+		t.Errorf("got payment %+v, want it captured with a gateway reference", p)
+	}
+	checkStatuses(t, dbs, order.Id, models.PaymentStatusCaptured, models.OrderStatusPaid)
+}
+
+func TestChargeOrderDecline(t *testing.T) {
+	dbs, fake, order := newPaymentTest(t, payment.OutcomeDecline)
+
+	if _, err := chargeOrder(context.Background(), dbs, fake, order, ""); err != nil {
+		t.Fatal(err)
+	}
+	checkStatuses(t, dbs, order.Id, models.PaymentStatusDeclined, models.OrderStatusCancelled)
+}
+
+// captureDecliner authorizes like the fake gateway but declines every capture.
+type captureDecliner struct {
+	*payment.FakeProvider
+}
+
+func (p captureDecliner) Capture(ctx context.Context, authorizationId string, amount float64) error {
+	return payment.ErrDeclined
+}
+
+func TestChargeOrderDeclinedCaptureVoidsAuthorization(t *testing.T) {
+	dbs, fake, order := newPaymentTest(t, payment.OutcomeSucceed)
+
+	p, err := chargeOrder(context.Background(), dbs, captureDecliner{fake}, order, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStatuses(t, dbs, order.Id, models.PaymentStatusDeclined, models.OrderStatusCancelled)
+	// voiding again fails once the authorization is gone
+	if err := fake.Void(context.Background(), *p.ProviderRef); err == nil {
+		t.Error("the authorization of the declined capture wasn't voided")
+	}
+}
+
+func TestChargeOrderTimeoutSettledByWebhook(t *testing.T) {
+	dbs, fake, order := newPaymentTest(t, payment.OutcomeTimeout)
+	h := NewPaymentHandler(dbs, fake)
+
+	if _, err := chargeOrder(context.Background(), dbs, fake, order, ""); err != nil {
+		t.Fatal(err)
+	}
+	checkStatuses(t, dbs, order.Id, models.PaymentStatusPending, models.OrderStatusPendingPayment)
+
+	paymentId := captureGatewaySide(t, fake, order)
+	event := payment.WebhookEvent{Type: payment.EventPaymentCaptured, OrderId: order.Id, PaymentId: paymentId}
+
+	if code := postWebhook(t, h, fake, event, false); code != fiber.StatusUnauthorized {
+		t.Errorf("unsigned webhook got %d, want %d", code, fiber.StatusUnauthorized)
+	}
+	checkStatuses(t, dbs, order.Id, models.PaymentStatusPending, models.OrderStatusPendingPayment)
+
+	if code := postWebhook(t, h, fake, event, true); code != fiber.StatusOK {
+		t.Fatalf("webhook got %d, want %d", code, fiber.StatusOK)
+	}
+	checkStatuses(t, dbs, order.Id, models.PaymentStatusCaptured, models.OrderStatusPaid)
+	if p := mustGetPayment(t, dbs, order.Id); p.ProviderRef == nil || *p.ProviderRef != paymentId {
+		t.Errorf("payment reference is %v, want %s", p.ProviderRef, paymentId)
+	}
+}
+
+func TestWebhookCaptureWithoutPaymentId(t *testing.T) {
+	dbs, fake, order := newPaymentTest(t, payment.OutcomeTimeout)
+	h := NewPaymentHandler(dbs, fake)
+
+	if _, err := chargeOrder(context.Background(), dbs, fake, order, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	event := payment.WebhookEvent{Type: payment.EventPaymentCaptured, OrderId: order.Id}
+	if code := postWebhook(t, h, fake, event, true); code != fiber.StatusBadRequest {
+		t.Errorf("webhook got %d, want %d", code, fiber.StatusBadRequest)
+	}
+	checkStatuses(t, dbs, order.Id, models.PaymentStatusPending, models.OrderStatusPendingPayment)
+}
+
+func TestWebhookLateCaptureIsRefunded(t *testing.T) {
+	dbs, fake, order := newPaymentTest(t, payment.OutcomeTimeout)
+	h := NewPaymentHandler(dbs, fake)
+
+	if _, err := chargeOrder(context.Background(), dbs, fake, order, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := dbs.CancelOrder(order.Id, order.UserId); err != nil {
+		t.Fatal(err)
+	}
+
+	paymentId := captureGatewaySide(t, fake, order)
+	event := payment.WebhookEvent{Type: payment.EventPaymentCaptured, OrderId: order.Id, PaymentId: paymentId}
+	if code := postWebhook(t, h, fake, event, true); code != fiber.StatusOK {
+		t.Fatalf("webhook got %d, want %d", code, fiber.StatusOK)
+	}
+	checkStatuses(t, dbs, order.Id, models.PaymentStatusRefunded, models.OrderStatusCancelled)
+	// refunding again fails once the whole capture was given back
+	if err := fake.Refund(context.Background(), paymentId, order.TotalPrice); err == nil {
+		t.Error("the late capture wasn't refunded")
+	}
+}
+
+// backdatePayment makes the order's payment old enough for
+// SettleCancelledPayments to pick it up.
+func backdatePayment(t *testing.T, dbs *database.DBService, oid int) {
+	t.Helper()
+	p := mustGetPayment(t, dbs, oid)
+	p.UpdatedAt = time.Now().UTC().Add(-settleRetryDelay * 2)
+	if err := dbs.UpdatePayment(p); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSettleCancelledPaymentsRetriesRefund(t *testing.T) {
+	dbs, fake, order := newPaymentTest(t, payment.OutcomeSucceed)
+	h := NewPaymentHandler(dbs, fake)
+
+	if _, err := chargeOrder(context.Background(), dbs, fake, order, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	fake.SetOutcome(payment.OutcomeTimeout)
+	if err := dbs.CancelOrder(order.Id, order.UserId); err != nil {
+		t.Fatal(err)
+	}
+	if err := settleOrderPayment(context.Background(), dbs, fake, order.Id); !errors.Is(err, payment.ErrTimeout) {
+		t.Fatalf("got %v, want %v", err, payment.ErrTimeout)
+	}
+	checkStatuses(t, dbs, order.Id, models.PaymentStatusRefundPending, models.OrderStatusCancelled)
+
+	backdatePayment(t, dbs, order.Id)
+	fake.SetOutcome(payment.OutcomeSucceed)
+	if err := h.SettleCancelledPayments(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	checkStatuses(t, dbs, order.Id, models.PaymentStatusRefunded, models.OrderStatusCancelled)
+}
+
+func TestSettleCancelledPaymentsWithoutProviderRef(t *testing.T) {
+	dbs, fake, order := newPaymentTest(t, payment.OutcomeTimeout)
+	h := NewPaymentHandler(dbs, fake)
+
+	if _, err := chargeOrder(context.Background(), dbs, fake, order, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := dbs.CancelOrder(order.Id, order.UserId); err != nil {
+		t.Fatal(err)
+	}
+	p := mustGetPayment(t, dbs, order.Id)
+	p.Status = models.PaymentStatusRefundPending
+	if err := dbs.UpdatePayment(p); err != nil {
+		t.Fatal(err)
+	}
+	backdatePayment(t, dbs, order.Id)
+
+	fake.SetOutcome(payment.OutcomeSucceed)
+	if err := h.SettleCancelledPayments(context.Background()); !errors.Is(err, errNoProviderRef) {
+		t.Errorf("got %v, want %v", err, errNoProviderRef)
+	}
+	checkStatuses(t, dbs, order.Id, models.PaymentStatusRefundPending, models.OrderStatusCancelled)
+}
@@ -0,0 +1,269 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/assaidy/bookstore/internals/database"
+	"github.com/assaidy/bookstore/internals/models"
+	"github.com/assaidy/bookstore/internals/moderation"
+	"github.com/assaidy/bookstore/internals/utils"
+	"github.com/gofiber/fiber/v2"
+)
+
+type ReviewHandler struct {
+	db      *database.DBService
+	flagger *moderation.WordFlagger
+}
+
+func NewReviewHandler(db *database.DBService, flagger *moderation.WordFlagger) *ReviewHandler {
+	return &ReviewHandler{db: db, flagger: flagger}
+}
+
+func (h *ReviewHandler) HandleCreateReview(c *fiber.Ctx) error {
+	req := models.ReviewCreateOrUpdateReq{}
+	if err := parseAndValidateReq(c, &req); err != nil {
+		return err
+	}
+
+	uid, _ := c.ParamsInt("uid")
+	bid, _ := c.ParamsInt("bid")
+
+	if ok, err := h.db.CheckIfBookExists(bid); err != nil {
+		return utils.InternalServerError(err)
+	} else if !ok {
+		return utils.NotFoundError(fmt.Sprintf("book with id %d not found", bid))
+	}
+
+	if ok, err := h.db.CheckIfReviewExists(uid, bid); err != nil {
+		return utils.InternalServerError(err)
+	} else if ok {
+		return utils.ConflictError(fmt.Sprintf("book with id %d is already reviewed, edit the review instead", bid))
+	}
+
+	review := models.Review{
+		UserId:    uid,
+		BookId:    bid,
+		Rating:    req.Rating,
+		Text:      strings.TrimSpace(req.Text),
+		Status:    models.ReviewStatusPending,
+		CreatedAt: time.Now().UTC(),
+	}
+	if err := h.db.CreateReview(&review, h.flagger.Check(review.Text)); err != nil {
+		if errors.Is(err, database.ErrReviewExists) {
+			return utils.ConflictError(fmt.Sprintf("book with id %d is already reviewed, edit the review instead", bid))
+		}
+		return utils.InternalServerError(err)
+	}
+
+	created, err := h.db.GetReview(uid, bid)
+	if err != nil {
+		return utils.InternalServerError(err)
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(utils.ApiResponse{
+		Message: "created successfully",
+		Data:    fiber.Map{"review": created},
+	})
+}
+
+func (h *ReviewHandler) HandleGetAllReviewsByBook(c *fiber.Ctx) error {
+	id, _ := c.ParamsInt("id") // book id
+
+	if ok, err := h.db.CheckIfBookExists(id); err != nil {
+		return utils.InternalServerError(err)
+	} else if !ok {
+		return utils.NotFoundError(fmt.Sprintf("book with id %d not found", id))
+	}
+
+	page, limit := getPaginationData(c)
+
+	reviews, err := h.db.GetAllReviewsByBook(id, page, limit)
+	if err != nil {
+		return utils.InternalServerError(err)
+	}
+
+	totalReviews, err := h.db.GetTotalReviewsByBook(id)
+	if err != nil {
+		return utils.InternalServerError(err)
+	}
+	totalPages := (totalReviews + limit - 1) / limit
+
+	return c.Status(fiber.StatusOK).JSON(utils.ApiResponse{
+		Message: "retrieved successfully",
+		Data: fiber.Map{
+			"reviews":    reviews,
+			"page":       page,
+			"limit":      limit,
+			"totalPages": totalPages,
+		},
+	})
+}
+
+func (h *ReviewHandler) HandleUpdateReview(c *fiber.Ctx) error {
+	req := models.ReviewCreateOrUpdateReq{}
+	if err := parseAndValidateReq(c, &req); err != nil {
+		return err
+	}
+
+	uid, _ := c.ParamsInt("uid")
+	bid, _ := c.ParamsInt("bid")
+
+	review, err := h.db.GetReview(uid, bid)
+	if err != nil {
+		return utils.InternalServerError(err)
+	}
+	if review == nil {
+		return utils.NotFoundError(fmt.Sprintf("review of book with id %d not found", bid))
+	}
+
+	// edits are moderated again
+	review.Rating = req.Rating
+	review.Text = strings.TrimSpace(req.Text)
+	review.Status = models.ReviewStatusPending
+	review.UpdatedAt = time.Now().UTC()
+	if err := h.db.UpdateReview(review, h.flagger.Check(review.Text)); err != nil {
+		return utils.InternalServerError(err)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(utils.ApiResponse{
+		Message: "updated successfully",
+		Data:    fiber.Map{"review": review},
+	})
+}
+
+func (h *ReviewHandler) HandleDeleteReview(c *fiber.Ctx) error {
+	uid, _ := c.ParamsInt("uid")
+	bid, _ := c.ParamsInt("bid")
+
+	if ok, err := h.db.CheckIfReviewExists(uid, bid); err != nil {
+		return utils.InternalServerError(err)
+	} else if !ok {
+		return utils.NotFoundError(fmt.Sprintf("review of book with id %d not found", bid))
+	}
+
+	if err := h.db.DeleteReview(uid, bid); err != nil {
+		return utils.InternalServerError(err)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(utils.ApiResponse{
+		Message: "deleted successfully",
+	})
+}
+
+func (h *ReviewHandler) HandleReportReview(c *fiber.Ctx) error {
+	req := models.ReviewReportReq{}
+	if err := parseAndValidateReq(c, &req); err != nil {
+		return err
+	}
+
+	id, _ := c.ParamsInt("id")
+	uid, ok := utils.GetUserIdFromContext(c)
+	if !ok {
+		return utils.UnauthorizedError()
+	}
+
+	// only public reviews can be reported
+	review, err := h.db.GetReviewById(id)
+	if err != nil {
+		return utils.InternalServerError(err)
+	}
+	if review == nil || review.Status != models.ReviewStatusApproved {
+		return utils.NotFoundError(fmt.Sprintf("review with id %d not found", id))
+	}
+	if review.UserId == uid {
+		return utils.InvalidDataError("cannot report your own review")
+	}
+
+	if ok, err := h.db.CheckIfReviewReported(id, uid); err != nil {
+		return utils.InternalServerError(err)
+	} else if ok {
+		return utils.ConflictError(fmt.Sprintf("review with id %d is already reported", id))
+	}
+
+	if err := h.db.CreateReviewReport(id, uid, strings.TrimSpace(req.Reason), time.Now().UTC()); err != nil {
+		if errors.Is(err, database.ErrReviewReported) {
+			return utils.ConflictError(fmt.Sprintf("review with id %d is already reported", id))
+		}
+		return utils.InternalServerError(err)
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(utils.ApiResponse{
+		Message: "reported successfully",
+	})
+}
+
+// HandleGetModerationQueue lists the reviews with the 'status' param
+// (pending by default). reported=true keeps only reviews with open reports.
+func (h *ReviewHandler) HandleGetModerationQueue(c *fiber.Ctx) error {
+	status := c.Query("status", models.ReviewStatusPending)
+	switch status {
+	case models.ReviewStatusPending, models.ReviewStatusApproved, models.ReviewStatusRejected:
+	default:
+		return utils.BadRequestError("'status' param takes only values {pending, approved, rejected}")
+	}
+	reportedOnly := false
+	if v := c.Query("reported"); v != "" {
+		var err error
+		if reportedOnly, err = strconv.ParseBool(v); err != nil {
+			return utils.BadRequestError("'reported' param takes only values {true, false}")
+		}
+	}
+	page, limit := getPaginationData(c)
+
+	reviews, err := h.db.GetModerationQueue(status, reportedOnly, page, limit)
+	if err != nil {
+		return utils.InternalServerError(err)
+	}
+
+	totalReviews, err := h.db.GetTotalModerationQueue(status, reportedOnly)
+	if err != nil {
+		return utils.InternalServerError(err)
+	}
+	totalPages := (totalReviews + limit - 1) / limit
+
+	return c.Status(fiber.StatusOK).JSON(utils.ApiResponse{
+		Message: "retrieved successfully",
+		Data: fiber.Map{
+			"reviews":    reviews,
+			"page":       page,
+			"limit":      limit,
+			"totalPages": totalPages,
+		},
+	})
+}
+
+func (h *ReviewHandler) HandleModerateReview(c *fiber.Ctx) error {
+	req := models.ReviewModerateReq{}
+	if err := parseAndValidateReq(c, &req); err != nil {
+		return err
+	}
+
+	id, _ := c.ParamsInt("id")
+	actorId, ok := utils.GetUserIdFromContext(c)
+	if !ok {
+		return utils.UnauthorizedError()
+	}
+
+	review, err := h.db.GetReviewById(id)
+	if err != nil {
+		return utils.InternalServerError(err)
+	}
+	if review == nil {
+		return utils.NotFoundError(fmt.Sprintf("review with id %d not found", id))
+	}
+
+	if err := h.db.ModerateReview(id, req.Status, req.UpdatedAt, actorId, time.Now().UTC()); err != nil {
+		if errors.Is(err, database.ErrReviewChanged) {
+			return utils.ConflictError("review was edited since it was loaded, reload it before moderating")
+		}
+		return utils.InternalServerError(err)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(utils.ApiResponse{
+		Message: "updated successfully",
+	})
+}
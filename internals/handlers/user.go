@@ -2,20 +2,23 @@ package handlers
 
 import (
 	"fmt"
+	"log"
 	"time"
 
 	"github.com/assaidy/bookstore/internals/database"
+	"github.com/assaidy/bookstore/internals/mail"
 	"github.com/assaidy/bookstore/internals/models"
 	"github.com/assaidy/bookstore/internals/utils"
 	"github.com/gofiber/fiber/v2"
 )
 
 type UserHandler struct {
-	db *database.DBService
+	db     *database.DBService
+	mailer mail.Sender
 }
 
-func NewUserHandler(db *database.DBService) *UserHandler {
-	return &UserHandler{db: db}
+func NewUserHandler(db *database.DBService, mailer mail.Sender) *UserHandler {
+	return &UserHandler{db: db, mailer: mailer}
 }
 
 // TODO: trim spaces
@@ -52,20 +55,27 @@ func (h *UserHandler) HandleRegisterUser(c *fiber.Ctx) error {
 		Password: hashedPassword,
 		Email:    req.Email,
 		Address:  req.Address,
+		Role:     models.RoleCustomer,
 		JoinedAt: time.Now().UTC(),
 	}
 	if err := h.db.CreateUser(&user); err != nil {
 		return utils.InternalServerError(err)
 	}
 
-	tokenStr, err := utils.GenerateJwtToken(user.Id, user.Username)
+	// the account is usable without verification, so don't fail the request
+	// if the mail can't be sent. the user can ask for another one.
+	if err := h.sendVerificationEmail(&user); err != nil {
+		log.Printf("failed to send verification email to user %d: %v", user.Id, err)
+	}
+
+	accessToken, refreshToken, err := h.issueTokens(&user, 0)
 	if err != nil {
 		return utils.InternalServerError(err)
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(utils.ApiResponse{
 		Message: "created successfully",
-		Data:    fiber.Map{"token": tokenStr, "user": user},
+		Data:    fiber.Map{"token": accessToken, "refreshToken": refreshToken, "user": user},
 	})
 }
 
@@ -83,14 +93,238 @@ func (h *UserHandler) HandleLoginUser(c *fiber.Ctx) error {
 		return utils.UnauthorizedError()
 	}
 
-	tokenStr, err := utils.GenerateJwtToken(user.Id, user.Username)
+	accessToken, refreshToken, err := h.issueTokens(user, 0)
 	if err != nil {
 		return utils.InternalServerError(err)
 	}
 
 	return c.Status(fiber.StatusOK).JSON(utils.ApiResponse{
 		Message: "logged in successfully",
-		Data:    fiber.Map{"token": tokenStr, "user": user},
+		Data:    fiber.Map{"token": accessToken, "refreshToken": refreshToken, "user": user},
+	})
+}
+
+// issueTokens creates an access token and a refresh token in the given family.
+// a new family is started if fid is 0.
+func (h *UserHandler) issueTokens(user *models.User, fid int) (string, string, error) {
+	if fid == 0 {
+		var err error
+		if fid, err = h.db.CreateTokenFamily(user.Id); err != nil {
+			return "", "", err
+		}
+	}
+
+	refreshToken, err := utils.GenerateOpaqueToken()
+	if err != nil {
+		return "", "", err
+	}
+	rt := models.RefreshToken{
+		FamilyId:  fid,
+		TokenHash: utils.HashToken(refreshToken),
+		ExpiresAt: time.Now().UTC().Add(utils.RefreshTokenTTL),
+	}
+	if err := h.db.CreateRefreshToken(&rt); err != nil {
+		return "", "", err
+	}
+
+	accessToken, err := utils.GenerateJwtToken(user.Id, user.Role, fid)
+	if err != nil {
+		return "", "", err
+	}
+
+	return accessToken, refreshToken, nil
+}
+
+func (h *UserHandler) HandleRefreshToken(c *fiber.Ctx) error {
+	req := models.RefreshTokenReq{}
+	if err := parseAndValidateReq(c, &req); err != nil {
+		return err
+	}
+
+	rt, err := h.db.GetRefreshTokenByHash(utils.HashToken(req.RefreshToken))
+	if err != nil {
+		return utils.InternalServerError(err)
+	}
+	if rt == nil || rt.FamilyRevoked {
+		return utils.UnauthorizedError()
+	}
+
+	// a refresh token can only be used once. seeing it again means it was
+	// leaked, so the whole family is revoked.
+	if ok, err := h.db.UseRefreshToken(rt.Id); err != nil {
+		return utils.InternalServerError(err)
+	} else if !ok {
+		if err := h.db.RevokeTokenFamily(rt.FamilyId); err != nil {
+			return utils.InternalServerError(err)
+		}
+		return utils.UnauthorizedError()
+	}
+
+	if time.Now().UTC().After(rt.ExpiresAt) {
+		return utils.UnauthorizedError()
+	}
+
+	user, err := h.db.GetUserById(rt.UserId)
+	if err != nil {
+		return utils.InternalServerError(err)
+	}
+	if user == nil {
+		return utils.UnauthorizedError()
+	}
+
+	accessToken, refreshToken, err := h.issueTokens(user, rt.FamilyId)
+	if err != nil {
+		return utils.InternalServerError(err)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(utils.ApiResponse{
+		Message: "refreshed successfully",
+		Data:    fiber.Map{"token": accessToken, "refreshToken": refreshToken},
+	})
+}
+
+func (h *UserHandler) HandleLogoutUser(c *fiber.Ctx) error {
+	fid, ok := utils.GetTokenFamilyIdFromContext(c)
+	if !ok {
+		return utils.UnauthorizedError()
+	}
+
+	if err := h.db.RevokeTokenFamily(fid); err != nil {
+		return utils.InternalServerError(err)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(utils.ApiResponse{
+		Message: "logged out successfully",
+	})
+}
+
+func (h *UserHandler) HandleForgotPassword(c *fiber.Ctx) error {
+	req := models.PasswordForgotReq{}
+	if err := parseAndValidateReq(c, &req); err != nil {
+		return err
+	}
+
+	// respond the same way whether the email exists or not, so this endpoint
+	// can't be used to find registered emails.
+	resp := utils.ApiResponse{
+		Message: "if the email is registered, a reset token has been sent to it",
+	}
+
+	user, err := h.db.GetUserByEmail(req.Email)
+	if err != nil {
+		return utils.InternalServerError(err)
+	}
+	if user == nil {
+		return c.Status(fiber.StatusOK).JSON(resp)
+	}
+
+	// failures past this point are only logged, answering differently would
+	// tell that the email is registered.
+	token, err := utils.GenerateOpaqueToken()
+	if err != nil {
+		log.Printf("failed to generate password reset token for user %d: %v", user.Id, err)
+		return c.Status(fiber.StatusOK).JSON(resp)
+	}
+	expiresAt := time.Now().UTC().Add(utils.PasswordResetTokenTTL)
+	if err := h.db.CreatePasswordResetToken(user.Id, utils.HashToken(token), expiresAt); err != nil {
+		log.Printf("failed to store password reset token for user %d: %v", user.Id, err)
+		return c.Status(fiber.StatusOK).JSON(resp)
+	}
+
+	if err := h.mailer.Send(mail.Message{
+		To:      user.Email,
+		Subject: "Reset your bookstore password",
+		Body: fmt.Sprintf(
+			"Hi %s,\n\nUse the following token to reset your password. It expires in %s.\n\n%s\n\nIf you didn't ask for this, you can ignore this email.\n",
+			user.Name, utils.PasswordResetTokenTTL, token),
+	}); err != nil {
+		log.Printf("failed to send password reset email to user %d: %v", user.Id, err)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(resp)
+}
+
+func (h *UserHandler) HandleResetPassword(c *fiber.Ctx) error {
+	req := models.PasswordResetReq{}
+	if err := parseAndValidateReq(c, &req); err != nil {
+		return err
+	}
+
+	hashedPassword, err := utils.HashPassword([]byte(req.Password))
+	if err != nil {
+		return utils.InternalServerError(err)
+	}
+
+	if ok, err := h.db.ResetPassword(utils.HashToken(req.Token), hashedPassword); err != nil {
+		return utils.InternalServerError(err)
+	} else if !ok {
+		return utils.InvalidDataError("invalid or expired reset token")
+	}
+
+	return c.Status(fiber.StatusOK).JSON(utils.ApiResponse{
+		Message: "password reset successfully",
+	})
+}
+
+func (h *UserHandler) sendVerificationEmail(user *models.User) error {
+	token, err := utils.GenerateOpaqueToken()
+	if err != nil {
+		return err
+	}
+	expiresAt := time.Now().UTC().Add(utils.EmailVerificationTokenTTL)
+	if err := h.db.CreateEmailVerificationToken(user.Id, utils.HashToken(token), expiresAt); err != nil {
+		return err
+	}
+
+	return h.mailer.Send(mail.Message{
+		To:      user.Email,
+		Subject: "Verify your bookstore email",
+		Body: fmt.Sprintf(
+			"Hi %s,\n\nUse the following token to verify your email. It expires in %s.\n\n%s\n",
+			user.Name, utils.EmailVerificationTokenTTL, token),
+	})
+}
+
+func (h *UserHandler) HandleVerifyEmail(c *fiber.Ctx) error {
+	token := c.Query("token")
+	if token == "" {
+		return utils.BadRequestError("plz set value for param 'token'")
+	}
+
+	if ok, err := h.db.VerifyEmail(utils.HashToken(token)); err != nil {
+		return utils.InternalServerError(err)
+	} else if !ok {
+		return utils.InvalidDataError("invalid or expired verification token")
+	}
+
+	return c.Status(fiber.StatusOK).JSON(utils.ApiResponse{
+		Message: "email verified successfully",
+	})
+}
+
+func (h *UserHandler) HandleResendVerificationEmail(c *fiber.Ctx) error {
+	id, ok := utils.GetUserIdFromContext(c)
+	if !ok {
+		return utils.UnauthorizedError()
+	}
+
+	user, err := h.db.GetUserById(id)
+	if err != nil {
+		return utils.InternalServerError(err)
+	}
+	if user == nil {
+		return utils.NotFoundError(fmt.Sprintf("user with id %d not found", id))
+	}
+	if user.VerifiedAt != nil {
+		return utils.ConflictError("email already verified")
+	}
+
+	if err := h.sendVerificationEmail(user); err != nil {
+		return utils.InternalServerError(err)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(utils.ApiResponse{
+		Message: "verification email sent",
 	})
 }
 
@@ -158,17 +392,67 @@ func (h *UserHandler) HandleUpdateUserById(c *fiber.Ctx) error {
 		}
 	}
 
+	passwordChanged := !utils.VerifyPasswrod([]byte(req.Password), []byte(user.Password))
 	hashedPassword, err := utils.HashPassword([]byte(req.Password))
 	if err != nil {
 		return utils.InternalServerError(err)
 	}
+	emailChanged := req.Email != user.Email
+
+	// a new password logs out every other session. the caller's own one is
+	// kept when they change their own password.
+	keepFamilyId := 0
+	if callerId, ok := utils.GetUserIdFromContext(c); ok && callerId == user.Id {
+		keepFamilyId, _ = utils.GetTokenFamilyIdFromContext(c)
+	}
+
 	user.Password = hashedPassword
 	user.Username = req.Username
 	user.Name = req.Name
 	user.Email = req.Email
 	user.Address = req.Address
+	if emailChanged {
+		user.VerifiedAt = nil
+	}
+
+	if err := h.db.UpdateUser(user, passwordChanged, keepFamilyId); err != nil {
+		return utils.InternalServerError(err)
+	}
 
-	if err := h.db.UpdateUser(user); err != nil {
+	if emailChanged {
+		if err := h.sendVerificationEmail(user); err != nil {
+			log.Printf("failed to send verification email to user %d: %v", user.Id, err)
+		}
+	}
+
+	return c.Status(fiber.StatusOK).JSON(utils.ApiResponse{
+		Message: "updated successfully",
+		Data:    fiber.Map{"user": user},
+	})
+}
+
+func (h *UserHandler) HandleUpdateUserRoleById(c *fiber.Ctx) error {
+	req := models.UserRoleUpdateReq{}
+	if err := parseAndValidateReq(c, &req); err != nil {
+		return err
+	}
+
+	id, _ := c.ParamsInt("id")
+
+	user, err := h.db.GetUserById(id)
+	if err != nil {
+		return utils.InternalServerError(err)
+	}
+	if user == nil {
+		return utils.NotFoundError(fmt.Sprintf("user with id %d not found", id))
+	}
+
+	user.Role = req.Role
+	if err := h.db.UpdateUserRole(user.Id, user.Role); err != nil {
+		return utils.InternalServerError(err)
+	}
+	// tokens carry the role, force the user to log in again to pick up the new one
+	if err := h.db.RevokeAllUserTokenFamilies(user.Id); err != nil {
 		return utils.InternalServerError(err)
 	}
 
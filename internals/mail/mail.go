@@ -0,0 +1,36 @@
+package mail
+
+import (
+	"log"
+	"os"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+type Sender interface {
+	Send(msg Message) error
+}
+
+// NewSender returns an SMTP sender if SMTP_HOST is set. otherwise mails are
+// written to MAIL_DIR (default "mail"), which is handy for local development.
+func NewSender() Sender {
+	if host := os.Getenv("SMTP_HOST"); host != "" {
+		return &SMTPSender{
+			Host:     host,
+			Port:     os.Getenv("SMTP_PORT"),
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     os.Getenv("MAIL_FROM"),
+		}
+	}
+	dir := os.Getenv("MAIL_DIR")
+	if dir == "" {
+		dir = "mail"
+	}
+	log.Printf("SMTP_HOST is not set, writing mails to %s/", dir)
+	return &FileSender{Dir: dir}
+}
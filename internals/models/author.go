@@ -0,0 +1,18 @@
+package models
+
+type Author struct {
+	Id   int    `json:"id"`
+	Name string `json:"name"`
+	Bio  string `json:"bio"`
+}
+
+// BookAuthor is an author as embedded in book responses.
+type BookAuthor struct {
+	Id   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+type AuthorCreateOrUpdateReq struct {
+	Name string `json:"name" validate:"required,max=255,notBlank"`
+	Bio  string `json:"bio" validate:"max=4096"`
+}
@@ -3,33 +3,119 @@ package models
 import "time"
 
 type Book struct {
+	Id                int           `json:"id"`
+	Title             string        `json:"title"`
+	Description       string        `json:"description"`
+	CategoryId        int           `json:"categoryId"`
+	CoverId           int           `json:"coverId"`
+	Price             float64       `json:"price"`
+	Quantity          int           `json:"quantity"`
+	AvailableQuantity int           `json:"availableQuantity"`
+	Discount          float64       `json:"discount"`
+	WeightGrams       int           `json:"weightGrams"`
+	Isbn10            *string       `json:"isbn10"`
+	Isbn13            *string       `json:"isbn13"`
+	AddedAt           time.Time     `json:"addedAt"`
+	PurchaseCount     int           `json:"purchaseCount"`
+	RatingAverage     float64       `json:"ratingAverage"`
+	RatingCount       int           `json:"ratingCount"`
+	Authors           []*BookAuthor `json:"authors"`
+}
+
+// BookFilter narrows book listings. zero values don't filter.
+type BookFilter struct {
+	Query       string // full-text search query
+	CategoryIds []int
+	AuthorIds   []int
+	MinPrice    *float64 // on the discounted price
+	MaxPrice    *float64 // on the discounted price
+	InStock     bool
+	Discounted  bool
+	AddedAfter  *time.Time
+	// books outside these categories are left out of the listing and of
+	// every facet, unlike with CategoryIds which the category facet ignores
+	ScopeCategoryIds []int
+}
+
+// BookCursor holds the sort keys of the last book on a page, so the next
+// page starts right after it.
+type BookCursor struct {
+	Sorting       string    `json:"sorting"`
 	Id            int       `json:"id"`
-	Title         string    `json:"title"`
-	Description   string    `json:"description"`
-	CategoryId    int       `json:"categoryId"`
-	CoverId       int       `json:"coverId"`
+	PurchaseCount int       `json:"purchaseCount"`
+	AddedAt       time.Time `json:"addedAt"`
 	Price         float64   `json:"price"`
-	Quantity      int       `json:"quantity"`
 	Discount      float64   `json:"discount"`
-	AddedAt       time.Time `json:"addedAt"`
-	PurchaseCount int       `json:"purchaseCount"`
+}
+
+func NewBookCursor(sorting string, book *Book) *BookCursor {
+	return &BookCursor{
+		Sorting:       sorting,
+		Id:            book.Id,
+		PurchaseCount: book.PurchaseCount,
+		AddedAt:       book.AddedAt,
+		Price:         book.Price,
+		Discount:      book.Discount,
+	}
+}
+
+type BookFacets struct {
+	Categories   []*CategoryFacet    `json:"categories"`
+	PriceBuckets []*PriceBucketFacet `json:"priceBuckets"`
+	Availability AvailabilityFacet   `json:"availability"`
+}
+
+type CategoryFacet struct {
+	Id    int    `json:"id"`
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// PriceBucketFacet counts books with a discounted price in [Min, Max). the
+// last bucket has no Max.
+type PriceBucketFacet struct {
+	Min   float64  `json:"min"`
+	Max   *float64 `json:"max"`
+	Count int      `json:"count"`
+}
+
+type AvailabilityFacet struct {
+	InStock    int `json:"inStock"`
+	OutOfStock int `json:"outOfStock"`
+}
+
+type BookSearchResult struct {
+	Book
+	Rank       float64        `json:"rank"`
+	Highlights BookHighlights `json:"highlights"`
+}
+
+type BookHighlights struct {
+	Title       string `json:"title"`
+	Description string `json:"description"`
 }
 
 type BookCreateRequest struct {
-	Title         string  `json:"title" validate:"required,notBlank"`
-	Description   string  `json:"description" validate:"required,notBlank"`
-	CategoryId    int     `json:"categoryId" validate:"required,number"`
-	CoverId       int     `json:"coverId" validate:"required,number"`
-	Price         float64 `json:"price" validate:"required,number,gte=0"`
-	Quantity      int     `json:"quantity" validate:"required,number,gte=0"`
-	Discount      float64 `json:"discount" validate:"required,number,gte=0"`
+	Title       string  `json:"title" validate:"required,notBlank"`
+	Description string  `json:"description" validate:"required,notBlank"`
+	CategoryId  int     `json:"categoryId" validate:"required,number"`
+	CoverId     int     `json:"coverId" validate:"required,number"`
+	Price       float64 `json:"price" validate:"required,number,gte=0"`
+	Quantity    int     `json:"quantity" validate:"required,number,gte=0"`
+	Discount    float64 `json:"discount" validate:"required,number,gte=0"`
+	WeightGrams int     `json:"weightGrams" validate:"omitempty,number,gt=0"`
+	AuthorIds   []int   `json:"authorIds" validate:"omitempty,dive,gt=0"`
+	Isbn        string  `json:"isbn" validate:"omitempty,validIsbn"`
 }
 
 type BookUpdateRequest struct {
-	Title         string  `json:"title" validate:"required,notBlank"`
-	Description   string  `json:"description" validate:"required,notBlank"`
-	CategoryId    int     `json:"categoryId" validate:"required,number"`
-	Price         float64 `json:"price" validate:"required,number,gte=0"`
-	Quantity      int     `json:"quantity" validate:"required,number,gte=0"`
-	Discount      float64 `json:"discount" validate:"required,number,gte=0"`
+	Title       string  `json:"title" validate:"required,notBlank"`
+	Description string  `json:"description" validate:"required,notBlank"`
+	CategoryId  int     `json:"categoryId" validate:"required,number"`
+	Price       float64 `json:"price" validate:"required,number,gte=0"`
+	Quantity    int     `json:"quantity" validate:"required,number,gte=0"`
+	Discount    float64 `json:"discount" validate:"required,number,gte=0"`
+	WeightGrams int     `json:"weightGrams" validate:"omitempty,number,gt=0"`
+	AuthorIds   []int   `json:"authorIds" validate:"omitempty,dive,gt=0"`
+	Isbn        string  `json:"isbn" validate:"omitempty,validIsbn"`
 }
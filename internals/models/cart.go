@@ -1,10 +1,13 @@
 package models
 
+import "time"
+
 type CartBook struct {
-	UserId        int     `json:"userId"`
-	BookId        int     `json:"bookId"`
-	Quantity      int     `json:"quantity"`
-	PricePerUnite float64 `json:"pricePerUnite"`
+	UserId        int       `json:"userId"`
+	BookId        int       `json:"bookId"`
+	Quantity      int       `json:"quantity"`
+	PricePerUnite float64   `json:"pricePerUnite"`
+	ReservedUntil time.Time `json:"reservedUntil"`
 }
 
 type CartAddBookReq struct {
@@ -1,10 +1,29 @@
 package models
 
 type Category struct {
-	Id   int    `json:"id"`
-	Name string `json:"name"`
+	Id       int    `json:"id"`
+	Name     string `json:"name"`
+	ParentId *int   `json:"parentId"`
+}
+
+// CategoryNode is a category in the category tree, with its subcategories.
+type CategoryNode struct {
+	Id       int             `json:"id"`
+	Name     string          `json:"name"`
+	Children []*CategoryNode `json:"children"`
 }
 
 type CategoryCreateOrUpdateReq struct {
 	Name string `json:"name" validate:"required,min=3,max=32,notBlank"`
 }
+
+type CategoryCreateReq struct {
+	Name     string `json:"name" validate:"required,min=3,max=32,notBlank"`
+	ParentId *int   `json:"parentId" validate:"omitempty,gt=0"`
+}
+
+// CategoryMoveReq moves a category under another; a null ParentId makes it
+// a top-level category.
+type CategoryMoveReq struct {
+	ParentId *int `json:"parentId" validate:"omitempty,gt=0"`
+}
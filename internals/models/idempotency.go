@@ -0,0 +1,13 @@
+package models
+
+import "time"
+
+type IdempotencyRecord struct {
+	UserId       int
+	Key          string
+	RequestHash  string
+	StatusCode   *int
+	ContentType  string
+	ResponseBody []byte
+	CreatedAt    time.Time
+}
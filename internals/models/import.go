@@ -0,0 +1,28 @@
+package models
+
+// BookImportRow is one book of a catalog import file.
+type BookImportRow struct {
+	Title       string  `json:"title" validate:"required,max=255,notBlank"`
+	Description string  `json:"description" validate:"required,notBlank"`
+	Category    string  `json:"category" validate:"required,notBlank"` // category name
+	Price       float64 `json:"price" validate:"required,gte=0,lte=99999999.99"`
+	Quantity    int     `json:"quantity" validate:"gte=0,lte=2147483647"`
+	Discount    float64 `json:"discount" validate:"gte=0,lte=100"`
+	Isbn        string  `json:"isbn" validate:"omitempty,validIsbn"`
+	WeightGrams int     `json:"weightGrams" validate:"omitempty,gt=0,lte=2147483647"`
+	Cover       string  `json:"cover"` // image url, data url or base64 content
+}
+
+// BookImportRowError lists what's wrong with a row, by field. rows are
+// numbered from 1, not counting the csv header.
+type BookImportRowError struct {
+	Row    int               `json:"row"`
+	Errors map[string]string `json:"errors"`
+}
+
+type BookImportReport struct {
+	DryRun   bool                  `json:"dryRun"`
+	Rows     int                   `json:"rows"`
+	Imported int                   `json:"imported"`
+	Errors   []*BookImportRowError `json:"errors"`
+}
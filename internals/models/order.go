@@ -1,13 +1,53 @@
 package models
 
-import "time"
+import (
+	"slices"
+	"time"
+)
+
+const (
+	OrderStatusPendingPayment = "pending_payment"
+	OrderStatusPaid           = "paid"
+	OrderStatusShipped        = "shipped"
+	OrderStatusDelivered      = "delivered"
+	OrderStatusCancelled      = "cancelled"
+)
+
+// orderStatusTransitions lists the statuses an order can move to from each status.
+var orderStatusTransitions = map[string][]string{
+	OrderStatusPendingPayment: {OrderStatusPaid, OrderStatusCancelled},
+	OrderStatusPaid:           {OrderStatusShipped, OrderStatusCancelled},
+	OrderStatusShipped:        {OrderStatusDelivered},
+	OrderStatusDelivered:      {},
+	OrderStatusCancelled:      {},
+}
+
+func CanTransitionOrderStatus(from, to string) bool {
+	return slices.Contains(orderStatusTransitions[from], to)
+}
 
 type Order struct {
-	Id         int          `json:"id"`
-	UserId     int          `json:"userId"`
-	AppliedAt  time.Time    `json:"appliedAt"`
-	TotalPrice float64      `json:"totalPrice"`
-	OrderBooks []*OrderBook `json:"orderBooks"`
+	Id              int                  `json:"id"`
+	UserId          int                  `json:"userId"`
+	AppliedAt       time.Time            `json:"appliedAt"`
+	TotalPrice      float64              `json:"totalPrice"`
+	ShippingService string               `json:"shippingService"`
+	ShippingCost    float64              `json:"shippingCost"`
+	TrackingNumber  *string              `json:"trackingNumber"`
+	Status          string               `json:"status"`
+	OrderBooks      []*OrderBook         `json:"orderBooks"`
+	StatusHistory   []*OrderStatusChange `json:"statusHistory,omitempty"`
+}
+
+// OrderCursor holds the sort keys of the last order on a page. orders are
+// listed newest first.
+type OrderCursor struct {
+	Id        int       `json:"id"`
+	AppliedAt time.Time `json:"appliedAt"`
+}
+
+func NewOrderCursor(order *Order) *OrderCursor {
+	return &OrderCursor{Id: order.Id, AppliedAt: order.AppliedAt}
 }
 
 type OrderBook struct {
@@ -15,3 +55,19 @@ type OrderBook struct {
 	Quantity      int     `json:"quantity"`
 	PricePerUnite float64 `json:"pricePerUnite"`
 }
+
+type OrderStatusChange struct {
+	FromStatus *string   `json:"fromStatus"`
+	ToStatus   string    `json:"toStatus"`
+	ChangedBy  *int      `json:"changedBy"`
+	ChangedAt  time.Time `json:"changedAt"`
+}
+
+type OrderStatusUpdateReq struct {
+	Status string `json:"status" validate:"required,oneof=pending_payment paid shipped delivered cancelled"`
+}
+
+type OrderApplyReq struct {
+	PaymentMethod   string `json:"paymentMethod" validate:"omitempty,notBlank"`
+	ShippingService string `json:"shippingService" validate:"omitempty,notBlank"`
+}
@@ -0,0 +1,27 @@
+package models
+
+import "time"
+
+const (
+	PaymentStatusPending    = "pending"
+	PaymentStatusAuthorized = "authorized"
+	PaymentStatusCaptured   = "captured"
+	PaymentStatusDeclined   = "declined"
+	PaymentStatusRefunded   = "refunded"
+	PaymentStatusVoided     = "voided"
+
+	// set when the order is cancelled, until the gateway refunds the capture
+	// or voids the authorization
+	PaymentStatusRefundPending = "refund_pending"
+	PaymentStatusVoidPending   = "void_pending"
+)
+
+type Payment struct {
+	Id          int       `json:"id"`
+	OrderId     int       `json:"orderId"`
+	ProviderRef *string   `json:"providerRef"`
+	Amount      float64   `json:"amount"`
+	Status      string    `json:"status"`
+	CreatedAt   time.Time `json:"createdAt"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+}
@@ -0,0 +1,53 @@
+package models
+
+import "time"
+
+// reviews wait as pending until staff approve them; only approved reviews
+// are public.
+const (
+	ReviewStatusPending  = "pending"
+	ReviewStatusApproved = "approved"
+	ReviewStatusRejected = "rejected"
+)
+
+// Review is a user's rating of a book. VerifiedPurchase is set when the user
+// has a delivered order with the book.
+type Review struct {
+	Id               int       `json:"id"`
+	UserId           int       `json:"userId"`
+	Username         string    `json:"username"`
+	BookId           int       `json:"bookId"`
+	Rating           int       `json:"rating"`
+	Text             string    `json:"text"`
+	VerifiedPurchase bool      `json:"verifiedPurchase"`
+	Status           string    `json:"status"`
+	CreatedAt        time.Time `json:"createdAt"`
+	UpdatedAt        time.Time `json:"updatedAt"`
+}
+
+type ReviewCreateOrUpdateReq struct {
+	Rating int    `json:"rating" validate:"required,min=1,max=5"`
+	Text   string `json:"text" validate:"max=4096"`
+}
+
+// ModeratedReview is a review as staff see it in the moderation queue.
+// FlaggedWords are the listed words found when it was submitted, and
+// OpenReports counts the abuse reports since it was last moderated.
+type ModeratedReview struct {
+	Review
+	FlaggedWords []string   `json:"flaggedWords"`
+	OpenReports  int        `json:"openReports"`
+	ModeratedBy  *int       `json:"moderatedBy"`
+	ModeratedAt  *time.Time `json:"moderatedAt"`
+}
+
+// ReviewModerateReq carries the review's updatedAt as the moderator saw it,
+// so edits made in the meantime aren't approved unseen.
+type ReviewModerateReq struct {
+	Status    string    `json:"status" validate:"required,oneof=approved rejected"`
+	UpdatedAt time.Time `json:"updatedAt" validate:"required"`
+}
+
+type ReviewReportReq struct {
+	Reason string `json:"reason" validate:"required,max=1024,notBlank"`
+}
@@ -0,0 +1,26 @@
+package models
+
+import "time"
+
+type RefreshToken struct {
+	Id            int
+	FamilyId      int
+	UserId        int
+	TokenHash     string
+	ExpiresAt     time.Time
+	UsedAt        *time.Time
+	FamilyRevoked bool
+}
+
+type RefreshTokenReq struct {
+	RefreshToken string `json:"refreshToken" validate:"required,notBlank"`
+}
+
+type PasswordForgotReq struct {
+	Email string `json:"email" validate:"required,email"`
+}
+
+type PasswordResetReq struct {
+	Token    string `json:"token" validate:"required,notBlank"`
+	Password string `json:"password" validate:"required,min=8,max=32,notBlank"`
+}
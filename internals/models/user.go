@@ -2,14 +2,22 @@ package models
 
 import "time"
 
+const (
+	RoleCustomer = "customer"
+	RoleStaff    = "staff"
+	RoleAdmin    = "admin"
+)
+
 type User struct {
-	Id       int       `json:"id"`
-	Name     string    `json:"name"`
-	Username string    `json:"username"`
-	Password string    `json:"-"`
-	Email    string    `json:"email"`
-	Address  string    `json:"address"`
-	JoinedAt time.Time `json:"joinedAt"`
+	Id         int        `json:"id"`
+	Name       string     `json:"name"`
+	Username   string     `json:"username"`
+	Password   string     `json:"-"`
+	Email      string     `json:"email"`
+	Address    string     `json:"address"`
+	Role       string     `json:"role"`
+	JoinedAt   time.Time  `json:"joinedAt"`
+	VerifiedAt *time.Time `json:"verifiedAt"`
 }
 
 type UserRegisterOrUpdateReq struct {
@@ -24,3 +32,7 @@ type UserLoginReq struct {
 	Username string `json:"username" validate:"required,min=3,max=32,startsWithLetter"`
 	Password string `json:"password" validate:"required,min=8,max=32,notBlank"`
 }
+
+type UserRoleUpdateReq struct {
+	Role string `json:"role" validate:"required,oneof=customer staff admin"`
+}
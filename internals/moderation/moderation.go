@@ -0,0 +1,76 @@
+package moderation
+
+import (
+	"bufio"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// WordFlagger flags texts containing any word of a list, as whole words and
+// ignoring case.
+type WordFlagger struct {
+	re *regexp.Regexp
+}
+
+func NewWordFlagger(words []string) *WordFlagger {
+	quoted := make([]string, 0, len(words))
+	for _, w := range words {
+		if w = strings.TrimSpace(w); w != "" {
+			quoted = append(quoted, regexp.QuoteMeta(strings.ToLower(w)))
+		}
+	}
+	if len(quoted) == 0 {
+		return &WordFlagger{}
+	}
+	return &WordFlagger{re: regexp.MustCompile(`(?i)\b(` + strings.Join(quoted, "|") + `)\b`)}
+}
+
+// NewFlagger builds the flagger from the comma separated REVIEW_FLAGGED_WORDS
+// and the REVIEW_FLAGGED_WORDS_FILE file, which has a word per line and may
+// have # comments. with neither set nothing is flagged.
+func NewFlagger() (*WordFlagger, error) {
+	var words []string
+	if v := os.Getenv("REVIEW_FLAGGED_WORDS"); v != "" {
+		words = append(words, strings.Split(v, ",")...)
+	}
+
+	if path := os.Getenv("REVIEW_FLAGGED_WORDS_FILE"); path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line != "" && !strings.HasPrefix(line, "#") {
+				words = append(words, line)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	return NewWordFlagger(words), nil
+}
+
+// Check returns the listed words found in the text, lowercased and without
+// duplicates.
+func (f *WordFlagger) Check(text string) []string {
+	found := make([]string, 0)
+	if f.re == nil {
+		return found
+	}
+	seen := make(map[string]bool)
+	for _, m := range f.re.FindAllString(text, -1) {
+		m = strings.ToLower(m)
+		if !seen[m] {
+			seen[m] = true
+			found = append(found, m)
+		}
+	}
+	return found
+}
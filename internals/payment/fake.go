@@ -0,0 +1,166 @@
+package payment
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+type Outcome int
+
+const (
+	OutcomeSucceed Outcome = iota
+	OutcomeDecline
+	OutcomeTimeout
+)
+
+func ParseOutcome(s string) (Outcome, error) {
+	switch s {
+	case "", "succeed":
+		return OutcomeSucceed, nil
+	case "decline":
+		return OutcomeDecline, nil
+	case "timeout":
+		return OutcomeTimeout, nil
+	default:
+		return 0, fmt.Errorf("unknown fake payment outcome %q", s)
+	}
+}
+
+// FakeProvider is a deterministic in-process gateway. every call succeeds,
+// declines or times out depending on the configured outcome, and ids are
+// handed out sequentially. webhooks are signed with HMAC-SHA256 of the
+// payload using the webhook secret.
+type FakeProvider struct {
+	mu             sync.Mutex
+	outcome        Outcome
+	webhookSecret  []byte
+	nextId         int
+	authorizations map[string]float64
+	captured       map[string]float64
+	refunded       map[string]float64
+}
+
+func NewFakeProvider(outcome Outcome, webhookSecret string) *FakeProvider {
+	return &FakeProvider{
+		outcome:        outcome,
+		webhookSecret:  []byte(webhookSecret),
+		authorizations: make(map[string]float64),
+		captured:       make(map[string]float64),
+		refunded:       make(map[string]float64),
+	}
+}
+
+func (p *FakeProvider) SetOutcome(outcome Outcome) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.outcome = outcome
+}
+
+func (p *FakeProvider) result() error {
+	switch p.outcome {
+	case OutcomeDecline:
+		return ErrDeclined
+	case OutcomeTimeout:
+		return ErrTimeout
+	default:
+		return nil
+	}
+}
+
+func (p *FakeProvider) Authorize(ctx context.Context, req AuthorizeRequest) (*Authorization, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := p.result(); err != nil {
+		return nil, err
+	}
+	p.nextId++
+	id := fmt.Sprintf("fake_pay_%d", p.nextId)
+	p.authorizations[id] = req.Amount
+	return &Authorization{Id: id, Amount: req.Amount}, nil
+}
+
+func (p *FakeProvider) Capture(ctx context.Context, authorizationId string, amount float64) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := p.result(); err != nil {
+		return err
+	}
+	authorized, ok := p.authorizations[authorizationId]
+	if !ok {
+		return fmt.Errorf("unknown authorization %q", authorizationId)
+	}
+	if amount > authorized {
+		return fmt.Errorf("capture amount %.2f exceeds authorized amount %.2f", amount, authorized)
+	}
+	p.captured[authorizationId] = amount
+	return nil
+}
+
+func (p *FakeProvider) Refund(ctx context.Context, paymentId string, amount float64) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := p.result(); err != nil {
+		return err
+	}
+	captured, ok := p.captured[paymentId]
+	if !ok {
+		return fmt.Errorf("payment %q was not captured", paymentId)
+	}
+	if p.refunded[paymentId]+amount > captured {
+		return fmt.Errorf("refund amount %.2f exceeds captured amount %.2f", amount, captured)
+	}
+	p.refunded[paymentId] += amount
+	return nil
+}
+
+func (p *FakeProvider) Void(ctx context.Context, authorizationId string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := p.result(); err != nil {
+		return err
+	}
+	if _, ok := p.authorizations[authorizationId]; !ok {
+		return fmt.Errorf("unknown authorization %q", authorizationId)
+	}
+	if _, ok := p.captured[authorizationId]; ok {
+		return fmt.Errorf("authorization %q was already captured", authorizationId)
+	}
+	delete(p.authorizations, authorizationId)
+	return nil
+}
+
+func (p *FakeProvider) VerifyWebhook(payload []byte, signature string) (*WebhookEvent, error) {
+	expected := p.Sign(payload)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return nil, ErrInvalidSignature
+	}
+	event := WebhookEvent{}
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return nil, err
+	}
+	return &event, nil
+}
+
+// Sign returns the signature the fake gateway would send with payload.
+func (p *FakeProvider) Sign(payload []byte) string {
+	mac := hmac.New(sha256.New, p.webhookSecret)
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
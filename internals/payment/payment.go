@@ -0,0 +1,76 @@
+package payment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+)
+
+var (
+	ErrDeclined         = errors.New("payment declined")
+	ErrTimeout          = errors.New("payment provider timed out")
+	ErrInvalidSignature = errors.New("invalid webhook signature")
+)
+
+const (
+	EventPaymentCaptured = "payment.captured"
+	EventPaymentFailed   = "payment.failed"
+)
+
+type AuthorizeRequest struct {
+	OrderId int
+	UserId  int
+	Amount  float64
+	// opaque token from the client, e.g. a tokenized card. empty charges the
+	// user's default payment method at the gateway.
+	PaymentMethod string
+}
+
+type Authorization struct {
+	Id     string
+	Amount float64
+}
+
+type WebhookEvent struct {
+	Type      string `json:"type"`
+	OrderId   int    `json:"orderId"`
+	PaymentId string `json:"paymentId"`
+}
+
+// PaymentProvider is implemented by every payment gateway the store can
+// charge through. calls that can't reach the gateway in time should return
+// ErrTimeout, and rejected payments ErrDeclined.
+type PaymentProvider interface {
+	Authorize(ctx context.Context, req AuthorizeRequest) (*Authorization, error)
+	Capture(ctx context.Context, authorizationId string, amount float64) error
+	Refund(ctx context.Context, paymentId string, amount float64) error
+	// Void releases an authorization that wasn't captured.
+	Void(ctx context.Context, authorizationId string) error
+	// VerifyWebhook checks the signature of a webhook payload sent by the
+	// gateway and decodes it.
+	VerifyWebhook(payload []byte, signature string) (*WebhookEvent, error)
+}
+
+// NewProvider builds the provider selected by PAYMENT_PROVIDER. only the
+// in-process fake gateway exists for now, and it has to be asked for by name
+// so a deploy missing its payment config doesn't accept every order.
+func NewProvider() (PaymentProvider, error) {
+	webhookSecret := os.Getenv("PAYMENT_WEBHOOK_SECRET")
+	if webhookSecret == "" {
+		return nil, errors.New("PAYMENT_WEBHOOK_SECRET is not set")
+	}
+
+	switch name := os.Getenv("PAYMENT_PROVIDER"); name {
+	case "":
+		return nil, errors.New("PAYMENT_PROVIDER is not set")
+	case "fake":
+		outcome, err := ParseOutcome(os.Getenv("FAKE_PAYMENT_OUTCOME"))
+		if err != nil {
+			return nil, err
+		}
+		return NewFakeProvider(outcome, webhookSecret), nil
+	default:
+		return nil, fmt.Errorf("unknown payment provider %q", name)
+	}
+}
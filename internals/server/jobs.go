@@ -0,0 +1,46 @@
+package server
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/assaidy/bookstore/internals/handlers"
+)
+
+// StartBackgroundJobs starts the periodic maintenance jobs. they run for the
+// lifetime of the process.
+func (s *FiberServer) StartBackgroundJobs() {
+	go runEvery(time.Minute, "release expired reservations", func() error {
+		n, err := s.db.ReleaseExpiredReservations()
+		if err == nil && n > 0 {
+			log.Printf("released %d expired cart reservations", n)
+		}
+		return err
+	})
+	paymentH := handlers.NewPaymentHandler(s.db, s.payments)
+	go runEvery(time.Minute, "settle cancelled payments", func() error {
+		return paymentH.SettleCancelledPayments(context.Background())
+	})
+	go runEvery(time.Hour, "delete expired idempotency keys", func() error {
+		_, err := s.db.DeleteIdempotencyKeysBefore(time.Now().UTC().Add(-idempotencyKeyTTL))
+		return err
+	})
+	// user recommendations build on the book affinities
+	go runEvery(time.Hour, "refresh recommendations", func() error {
+		if err := s.db.RefreshBookAffinities(); err != nil {
+			return err
+		}
+		return s.db.RefreshUserRecommendations()
+	})
+}
+
+func runEvery(interval time.Duration, name string, job func() error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := job(); err != nil {
+			log.Printf("job %q failed: %v", name, err)
+		}
+	}
+}
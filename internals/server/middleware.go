@@ -0,0 +1,159 @@
+package server
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"github.com/assaidy/bookstore/internals/database"
+	"github.com/assaidy/bookstore/internals/models"
+	"github.com/assaidy/bookstore/internals/utils"
+	"github.com/gofiber/fiber/v2"
+)
+
+// calls a request makes to outside services, like the payment gateway or the
+// shipping carrier, are cut off after this. keep it above the longest of
+// them, the cover downloads of a book import.
+const requestTimeout = time.Minute * 2
+
+// withRequestTimeout bounds the request's context by requestTimeout.
+func withRequestTimeout(c *fiber.Ctx) error {
+	ctx, cancel := context.WithTimeout(c.UserContext(), requestTimeout)
+	defer cancel()
+	c.SetUserContext(ctx)
+	return c.Next()
+}
+
+// requireRoles only lets the request through if the token role is one of roles.
+func requireRoles(roles ...string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		role, ok := utils.GetUserRoleFromContext(c)
+		if !ok {
+			return utils.UnauthorizedError()
+		}
+		if !slices.Contains(roles, role) {
+			return utils.ForbiddenError("insufficient role")
+		}
+		return c.Next()
+	}
+}
+
+// requireOwner only lets the request through if the user id in the route param
+// matches the token subject. admins can act on behalf of any user.
+func requireOwner(param string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		uid, ok := utils.GetUserIdFromContext(c)
+		if !ok {
+			return utils.UnauthorizedError()
+		}
+		role, ok := utils.GetUserRoleFromContext(c)
+		if !ok {
+			return utils.UnauthorizedError()
+		}
+		if role == models.RoleAdmin {
+			return c.Next()
+		}
+		if id, err := c.ParamsInt(param); err != nil || id != uid {
+			return utils.ForbiddenError("cannot access another user's resources")
+		}
+		return c.Next()
+	}
+}
+
+// requireActiveSession rejects access tokens whose refresh token family was
+// revoked (logout, role change) or whose user no longer exists.
+func requireActiveSession(db *database.DBService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		fid, ok := utils.GetTokenFamilyIdFromContext(c)
+		if !ok {
+			return utils.UnauthorizedError()
+		}
+		if ok, err := db.CheckIfTokenFamilyActive(fid); err != nil {
+			return utils.InternalServerError(err)
+		} else if !ok {
+			return utils.UnauthorizedError()
+		}
+		return c.Next()
+	}
+}
+
+const (
+	idempotencyKeyTTL = time.Hour * 24
+	// a key left in flight for longer than this belongs to a request that
+	// crashed, and a retry takes it over. it has to stay well above
+	// requestTimeout, or a retry could run alongside a slow request that is
+	// still going, e.g. charging the same checkout twice.
+	idempotencyInFlightTTL = requestTimeout * 5
+)
+
+// idempotency makes POST requests carrying an Idempotency-Key header safe to
+// retry. the first response for a key is stored and replayed for every retry
+// with the same body. reusing the key with a different request, or while the
+// first one is still running, is a conflict. server errors aren't stored, so
+// the request can be retried with the same key; handlers must not return them
+// once they have made changes.
+func idempotency(db *database.DBService) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		key := c.Get("Idempotency-Key")
+		if c.Method() != fiber.MethodPost || key == "" {
+			return c.Next()
+		}
+		if len(key) > 255 {
+			return utils.BadRequestError("Idempotency-Key must be at most 255 characters")
+		}
+
+		uid, ok := utils.GetUserIdFromContext(c)
+		if !ok {
+			return utils.UnauthorizedError()
+		}
+
+		rec := models.IdempotencyRecord{
+			UserId:      uid,
+			Key:         key,
+			RequestHash: utils.HashToken(c.Method() + " " + c.Path() + "\n" + string(c.Body())),
+			CreatedAt:   time.Now().UTC(),
+		}
+		requestHash := rec.RequestHash
+
+		claimed, err := db.ClaimIdempotencyKey(&rec, rec.CreatedAt.Add(-idempotencyInFlightTTL))
+		if err != nil {
+			return utils.InternalServerError(err)
+		}
+		if !claimed {
+			if rec.RequestHash != requestHash {
+				return utils.ConflictError("Idempotency-Key was already used with a different request")
+			}
+			if rec.StatusCode == nil {
+				return utils.ConflictError("a request with this Idempotency-Key is still being processed")
+			}
+			c.Set("Idempotent-Replayed", "true")
+			if rec.ContentType != "" {
+				c.Set(fiber.HeaderContentType, rec.ContentType)
+			}
+			return c.Status(*rec.StatusCode).Send(rec.ResponseBody)
+		}
+
+		// run the error handler here so error responses are stored too
+		if err := c.Next(); err != nil {
+			if err := c.App().ErrorHandler(c, err); err != nil {
+				return err
+			}
+		}
+
+		status := c.Response().StatusCode()
+		if status >= fiber.StatusInternalServerError {
+			if err := db.DeleteIdempotencyKey(uid, key); err != nil {
+				return utils.InternalServerError(err)
+			}
+			return nil
+		}
+
+		rec.StatusCode = &status
+		rec.ContentType = string(c.Response().Header.ContentType())
+		rec.ResponseBody = append([]byte(nil), c.Response().Body()...)
+		if err := db.CompleteIdempotencyKey(&rec); err != nil {
+			return utils.InternalServerError(err)
+		}
+		return nil
+	}
+}
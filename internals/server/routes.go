@@ -4,26 +4,44 @@ import (
 	"os"
 
 	"github.com/assaidy/bookstore/internals/handlers"
+	"github.com/assaidy/bookstore/internals/models"
 	jwtware "github.com/gofiber/contrib/jwt"
 )
 
 func (s *FiberServer) RegisterRoutes() {
 	var (
-		userH     = handlers.NewUserHandler(s.db)
+		userH     = handlers.NewUserHandler(s.db, s.mailer)
 		categoryH = handlers.NewCategoryHandler(s.db)
+		authorH   = handlers.NewAuthorHandler(s.db)
+		importH   = handlers.NewImportHandler(s.db)
+		exportH   = handlers.NewExportHandler(s.db)
+		reviewH   = handlers.NewReviewHandler(s.db, s.flagger)
 		coverH    = handlers.NewCoverHandler(s.db)
 		bookH     = handlers.NewBookHandler(s.db)
 		favH      = handlers.NewFavouritesHandler(s.db)
 		cartH     = handlers.NewCartHandler(s.db)
-		orderH    = handlers.NewOrderHandler(s.db)
+		orderH    = handlers.NewOrderHandler(s.db, s.payments, s.shipper, os.Getenv("REQUIRE_VERIFIED_EMAIL") == "true")
+		paymentH  = handlers.NewPaymentHandler(s.db, s.payments)
 	)
 
 	s.Post("/user/register", userH.HandleRegisterUser)
 	s.Post("/user/login", userH.HandleLoginUser)
+	s.Post("/user/refresh", userH.HandleRefreshToken)
+	s.Post("/user/password/forgot", userH.HandleForgotPassword)
+	s.Post("/user/password/reset", userH.HandleResetPassword)
+	s.Get("/user/verify", userH.HandleVerifyEmail)
+
+	s.Post("/payment/webhook", paymentH.HandlePaymentWebhook)
 
 	s.Get("/category", categoryH.HandleGetAllCategories)
+	s.Get("/category/tree", categoryH.HandleGetCategoryTree)
+	// takes the same params as GET /book; descendants=true includes books in subcategories
 	s.Get("/category/:id<int>", categoryH.HandleGetAllBooksByCategory)
 
+	s.Get("/author", authorH.HandleGetAllAuthors)
+	s.Get("/author/:id<int>", authorH.HandleGetAuthorById)
+	s.Get("/author/:id<int>/books", authorH.HandleGetAllBooksByAuthor)
+
 	// s.Post("/cover", coverH.HandleCreateCover) // FIX: delete this routes
 	s.Get("/cover/:id<int>", coverH.HandleGetCoverById)
 	// s.Delete("/cover/:id<int>", coverH.HandleDeleteCoverById) // FIX: delete this routes
@@ -33,46 +51,92 @@ func (s *FiberServer) RegisterRoutes() {
 	// - popularity (i.e. purchase count)
 	// - latest
 	// - price_asc
-    // - price_desc
+	// - price_desc
+	//
+	// filters (see getBookFilter):
+	// - category (multiple)
+	// - author (multiple)
+	// - minPrice, maxPrice (discounted price)
+	// - inStock, discounted
+	// - addedAfter
+	//
+	// facets=true adds category, price bucket and availability counts
 	//
 	// pagination:
 	// - total number of pages
 	// - current page data
 	//
 	s.Get("/book", bookH.HandleGetAllBooks)
+	s.Get("/book/search", bookH.HandleSearchBooks)
+	s.Get("/book/isbn/:isbn", bookH.HandleGetBookByIsbn)
 	s.Get("/book/:id<int>", bookH.HnadleGetBookById)
+	s.Get("/book/:id<int>/reviews", reviewH.HandleGetAllReviewsByBook)
+	s.Get("/book/:id<int>/related", bookH.HandleGetRelatedBooks)
 
 	s.Use(jwtware.New(jwtware.Config{
-		SigningKey: jwtware.SigningKey{Key: []byte(os.Getenv("JWT_SECRET"))},
+		SigningKey:     jwtware.SigningKey{Key: []byte(os.Getenv("JWT_SECRET"))},
+		SuccessHandler: requireActiveSession(s.db),
 	}))
+	s.Use(idempotency(s.db))
+
+	var (
+		adminOnly = requireRoles(models.RoleAdmin)
+		staffOnly = requireRoles(models.RoleStaff, models.RoleAdmin)
+		ownerId   = requireOwner("id")
+		ownerUid  = requireOwner("uid")
+	)
+
+	s.Post("/user/logout", userH.HandleLogoutUser)
+	s.Post("/user/verify/resend", userH.HandleResendVerificationEmail)
+	s.Get("/user", adminOnly, userH.HandleGetAllUsers)
+	s.Get("/user/:id<int>", ownerId, userH.HandleGetUserById)
+	s.Put("/user/:id<int>", ownerId, userH.HandleUpdateUserById)
+	s.Patch("/user/:id<int>/role", adminOnly, userH.HandleUpdateUserRoleById)
+	s.Delete("/user/:id<int>", ownerId, userH.HandleDeleteUserById)
+
+	s.Post("/category", staffOnly, categoryH.HandleCreateCategory)
+	s.Put("/category/:id<int>", staffOnly, categoryH.HandleUpdateCategoryById)
+	s.Patch("/category/:id<int>/parent", staffOnly, categoryH.HandleMoveCategory)
+	s.Delete("/category/:id<int>", staffOnly, categoryH.HandleDeleteCategoryById)
+
+	s.Post("/author", staffOnly, authorH.HandleCreateAuthor)
+	s.Put("/author/:id<int>", staffOnly, authorH.HandleUpdateAuthorById)
+	s.Delete("/author/:id<int>", staffOnly, authorH.HandleDeleteAuthorById)
+
+	s.Put("/cover/:id<int>", staffOnly, coverH.HandleUpdateCoverById)
 
-	// TODO: handle admin in jwt token creation
-	// TODO: create authenticate func: if user is not admin, check if id param maches token id (from context)
-	s.Get("/user", userH.HandleGetAllUsers)
-	s.Get("/user/:id<int>", userH.HandleGetUserById)
-	s.Put("/user/:id<int>", userH.HandleUpdateUserById)
-	s.Delete("/user/:id<int>", userH.HandleDeleteUserById)
+	s.Post("/admin/import/books", staffOnly, importH.HandleImportBooks)
+	s.Get("/admin/export/books", staffOnly, exportH.HandleExportBooks)
+	s.Get("/admin/export/orders", staffOnly, exportH.HandleExportOrders)
+	s.Get("/admin/export/users", adminOnly, exportH.HandleExportUsers)
+	s.Get("/admin/reviews", staffOnly, reviewH.HandleGetModerationQueue)
+	s.Patch("/admin/reviews/:id<int>", staffOnly, reviewH.HandleModerateReview)
 
-	s.Post("/category", categoryH.HandleCreateCategory)
-	s.Put("/category/:id<int>", categoryH.HandleUpdateCategoryById)
-	s.Delete("/category/:id<int>", categoryH.HandleDeleteCategoryById)
+	s.Post("/book", staffOnly, bookH.HandleCreateBook)
+	s.Put("/book/:id<int>", staffOnly, bookH.HnadleUpdateBookById)
+	s.Delete("/book/:id<int>", staffOnly, bookH.HnadleDeleteBookById)
 
-	s.Put("/cover/:id<int>", coverH.HandleUpdateCoverById)
+	s.Post("/user/:uid<int>/review/:bid<int>", ownerUid, reviewH.HandleCreateReview)
+	s.Put("/user/:uid<int>/review/:bid<int>", ownerUid, reviewH.HandleUpdateReview)
+	s.Delete("/user/:uid<int>/review/:bid<int>", ownerUid, reviewH.HandleDeleteReview)
+	s.Post("/review/:id<int>/report", reviewH.HandleReportReview)
 
-	s.Post("/book", bookH.HandleCreateBook)
-	s.Put("/book/:id<int>", bookH.HnadleUpdateBookById)
-	s.Delete("/book/:id<int>", bookH.HnadleDeleteBookById)
+	s.Get("/user/:uid<int>/recommendations", ownerUid, bookH.HandleGetUserRecommendations)
 
-	s.Post("/user/:uid<int>/favourite/:bid<int>", favH.HandleAddBookToFavourites)
-	s.Get("/user/:uid<int>/favourite", favH.HandleGetAllUserFavourites)
-	s.Delete("/user/:uid<int>/favourite/:bid<int>", favH.HandleDeleteBookFromFavourites)
+	s.Post("/user/:uid<int>/favourite/:bid<int>", ownerUid, favH.HandleAddBookToFavourites)
+	s.Get("/user/:uid<int>/favourite", ownerUid, favH.HandleGetAllUserFavourites)
+	s.Delete("/user/:uid<int>/favourite/:bid<int>", ownerUid, favH.HandleDeleteBookFromFavourites)
 
-	s.Post("/user/:uid<int>/cart", cartH.HandleAddToCart)
-	s.Get("/user/:uid<int>/cart", cartH.HandleGetBooksInCart)
-	s.Delete("/user/:uid<int>/cart/:bid<int>", cartH.HandleDeleteBookFromCart)
+	s.Post("/user/:uid<int>/cart", ownerUid, cartH.HandleAddToCart)
+	s.Get("/user/:uid<int>/cart", ownerUid, cartH.HandleGetBooksInCart)
+	s.Delete("/user/:uid<int>/cart/:bid<int>", ownerUid, cartH.HandleDeleteBookFromCart)
 
-	s.Post("/user/:uid<int>/order", orderH.HandleApplyOrder)
-	s.Get("/user/:uid<int>/order", orderH.HandleGetAllOrderByUser)
-	s.Get("/order", orderH.HandleGetAllOrders)
+	s.Get("/user/:uid<int>/shipping/rates", ownerUid, orderH.HandleGetShippingRates)
+	s.Post("/user/:uid<int>/order", ownerUid, orderH.HandleApplyOrder)
+	s.Get("/user/:uid<int>/order", ownerUid, orderH.HandleGetAllOrderByUser)
+	s.Post("/user/:uid<int>/order/:id<int>/cancel", ownerUid, orderH.HandleCancelOrderByUser)
+	s.Get("/order", staffOnly, orderH.HandleGetAllOrders)
 	s.Get("/order/:id<int>", orderH.HandleGetOrderById)
+	s.Patch("/order/:id<int>/status", staffOnly, orderH.HandleUpdateOrderStatus)
+	s.Post("/order/:id<int>/cancel", staffOnly, orderH.HandleCancelOrder)
 }
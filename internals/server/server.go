@@ -2,8 +2,13 @@ package server
 
 import (
 	"errors"
+	"log"
 
 	"github.com/assaidy/bookstore/internals/database"
+	"github.com/assaidy/bookstore/internals/mail"
+	"github.com/assaidy/bookstore/internals/moderation"
+	"github.com/assaidy/bookstore/internals/payment"
+	"github.com/assaidy/bookstore/internals/shipping"
 	"github.com/assaidy/bookstore/internals/utils"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/logger"
@@ -11,19 +16,40 @@ import (
 
 type FiberServer struct {
 	*fiber.App
-    db *database.DBService
+	db       *database.DBService
+	mailer   mail.Sender
+	payments payment.PaymentProvider
+	shipper  shipping.ShippingProvider
+	flagger  *moderation.WordFlagger
 }
 
 func NewFiberServer() *FiberServer {
+	payments, err := payment.NewProvider()
+	if err != nil {
+		log.Fatal(err)
+	}
+	shipper, err := shipping.NewProvider()
+	if err != nil {
+		log.Fatal(err)
+	}
+	flagger, err := moderation.NewFlagger()
+	if err != nil {
+		log.Fatal(err)
+	}
 	fs := &FiberServer{
 		App: fiber.New(fiber.Config{
 			ServerHeader: "bookstore",
 			AppName:      "bookstore",
 			ErrorHandler: errorHandler,
 		}),
-		db: database.NewDBService(),
+		db:       database.NewDBService(),
+		mailer:   mail.NewSender(),
+		payments: payments,
+		shipper:  shipper,
+		flagger:  flagger,
 	}
 	fs.Use(logger.New())
+	fs.Use(withRequestTimeout)
 	return fs
 }
 
@@ -0,0 +1,115 @@
+package shipping
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"sync"
+)
+
+type ServiceRate struct {
+	Service       string  `json:"service"`
+	BaseCost      float64 `json:"baseCost"`
+	PerKgCost     float64 `json:"perKgCost"`
+	EstimatedDays int     `json:"estimatedDays"`
+}
+
+// Zone prices shipping to every address that contains one of its keywords
+// (case insensitive). a zone without keywords matches every address, so it
+// should come last as the fallback.
+type Zone struct {
+	Name     string        `json:"name"`
+	Keywords []string      `json:"keywords"`
+	Rates    []ServiceRate `json:"rates"`
+}
+
+// DefaultZones is a single flat-rate zone for every address.
+func DefaultZones() []Zone {
+	return []Zone{
+		{
+			Name: "default",
+			Rates: []ServiceRate{
+				{Service: "standard", BaseCost: 5, PerKgCost: 1, EstimatedDays: 5},
+				{Service: "express", BaseCost: 12, PerKgCost: 2, EstimatedDays: 2},
+			},
+		},
+	}
+}
+
+func LoadZones(path string) ([]Zone, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	zones := make([]Zone, 0)
+	if err := json.Unmarshal(data, &zones); err != nil {
+		return nil, fmt.Errorf("failed to parse shipping zones: %w", err)
+	}
+	return zones, nil
+}
+
+// LocalProvider prices shipments from a zone table without calling a carrier.
+// tracking numbers are generated locally.
+type LocalProvider struct {
+	mu     sync.Mutex
+	zones  []Zone
+	nextId int
+}
+
+func NewLocalProvider(zones []Zone) *LocalProvider {
+	return &LocalProvider{zones: zones}
+}
+
+func (p *LocalProvider) zoneFor(address string) (*Zone, error) {
+	address = strings.ToLower(address)
+	for i, z := range p.zones {
+		if len(z.Keywords) == 0 {
+			return &p.zones[i], nil
+		}
+		for _, k := range z.Keywords {
+			if strings.Contains(address, strings.ToLower(k)) {
+				return &p.zones[i], nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("%w %q", ErrUnserviceableAddress, address)
+}
+
+func (p *LocalProvider) QuoteRates(ctx context.Context, req QuoteRequest) ([]Rate, error) {
+	zone, err := p.zoneFor(req.Address)
+	if err != nil {
+		return nil, err
+	}
+	// every started kilogram is charged
+	kgs := math.Ceil(float64(req.WeightGrams) / 1000)
+	rates := make([]Rate, 0, len(zone.Rates))
+	for _, r := range zone.Rates {
+		rates = append(rates, Rate{
+			Service:       r.Service,
+			Cost:          math.Round((r.BaseCost+r.PerKgCost*kgs)*100) / 100,
+			EstimatedDays: r.EstimatedDays,
+		})
+	}
+	return rates, nil
+}
+
+func (p *LocalProvider) CreateShipment(ctx context.Context, req ShipmentRequest) (*Shipment, error) {
+	rate, err := QuoteService(ctx, p, QuoteRequest{Address: req.Address, WeightGrams: req.WeightGrams}, req.Service)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	p.nextId++
+	seq := p.nextId
+	p.mu.Unlock()
+
+	return &Shipment{
+		TrackingNumber: fmt.Sprintf("LCL%08d%04d", req.OrderId, seq),
+		Service:        rate.Service,
+		Cost:           rate.Cost,
+	}, nil
+}
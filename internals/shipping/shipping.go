@@ -0,0 +1,76 @@
+package shipping
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+)
+
+var (
+	ErrUnknownService       = errors.New("unknown shipping service")
+	ErrUnserviceableAddress = errors.New("no shipping zone covers the address")
+)
+
+type QuoteRequest struct {
+	Address     string
+	WeightGrams int
+}
+
+type Rate struct {
+	Service       string  `json:"service"`
+	Cost          float64 `json:"cost"`
+	EstimatedDays int     `json:"estimatedDays"`
+}
+
+type ShipmentRequest struct {
+	OrderId     int
+	Address     string
+	WeightGrams int
+	Service     string
+}
+
+type Shipment struct {
+	TrackingNumber string
+	Service        string
+	Cost           float64
+}
+
+// ShippingProvider is implemented by every carrier the store can ship with.
+type ShippingProvider interface {
+	QuoteRates(ctx context.Context, req QuoteRequest) ([]Rate, error)
+	CreateShipment(ctx context.Context, req ShipmentRequest) (*Shipment, error)
+}
+
+// NewProvider builds the provider selected by SHIPPING_PROVIDER. only the
+// local zone table exists for now, optionally loaded from SHIPPING_ZONES_FILE.
+func NewProvider() (ShippingProvider, error) {
+	switch name := os.Getenv("SHIPPING_PROVIDER"); name {
+	case "", "local":
+		path := os.Getenv("SHIPPING_ZONES_FILE")
+		if path == "" {
+			return NewLocalProvider(DefaultZones()), nil
+		}
+		zones, err := LoadZones(path)
+		if err != nil {
+			return nil, err
+		}
+		return NewLocalProvider(zones), nil
+	default:
+		return nil, fmt.Errorf("unknown shipping provider %q", name)
+	}
+}
+
+// QuoteService returns the rate of one service from the provider's quotes.
+func QuoteService(ctx context.Context, p ShippingProvider, req QuoteRequest, service string) (*Rate, error) {
+	rates, err := p.QuoteRates(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rates {
+		if r.Service == service {
+			return &r, nil
+		}
+	}
+	return nil, fmt.Errorf("%w %q", ErrUnknownService, service)
+}
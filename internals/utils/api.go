@@ -78,3 +78,17 @@ func UnauthorizedError() ApiError {
 		Message: "unauthorized",
 	}
 }
+
+func PaymentRequiredError(msg string) ApiError {
+	return ApiError{
+		Code:    fiber.StatusPaymentRequired,
+		Message: msg,
+	}
+}
+
+func ForbiddenError(msg string) ApiError {
+	return ApiError{
+		Code:    fiber.StatusForbidden,
+		Message: msg,
+	}
+}
@@ -0,0 +1,50 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// EncodeCursor serializes v into an opaque pagination cursor, signed so
+// clients can't forge positions they weren't handed.
+func EncodeCursor(v any) (string, error) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	p := base64.RawURLEncoding.EncodeToString(payload)
+	return p + "." + base64.RawURLEncoding.EncodeToString(signCursor(p)), nil
+}
+
+// DecodeCursor verifies a cursor made by EncodeCursor and reads it into v.
+func DecodeCursor(cursor string, v any) error {
+	p, sig, ok := strings.Cut(cursor, ".")
+	if !ok {
+		return ErrInvalidCursor
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(mac, signCursor(p)) {
+		return ErrInvalidCursor
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(p)
+	if err != nil {
+		return ErrInvalidCursor
+	}
+	if err := json.Unmarshal(payload, v); err != nil {
+		return ErrInvalidCursor
+	}
+	return nil
+}
+
+func signCursor(payload string) []byte {
+	mac := hmac.New(sha256.New, []byte("cursor:"+os.Getenv("JWT_SECRET")))
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,75 @@
+package utils
+
+import (
+	"errors"
+	"strings"
+)
+
+var ErrInvalidISBN = errors.New("invalid isbn")
+
+// NormalizeISBN checks the check digit of an ISBN-10 or ISBN-13, written with
+// or without hyphens and spaces, and returns it as a bare ISBN-13.
+func NormalizeISBN(isbn string) (string, error) {
+	isbn = strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(isbn))
+
+	switch len(isbn) {
+	case 10:
+		sum := 0
+		for i, r := range isbn {
+			d := int(r - '0')
+			if r == 'X' && i == 9 {
+				d = 10
+			} else if r < '0' || r > '9' {
+				return "", ErrInvalidISBN
+			}
+			sum += (10 - i) * d
+		}
+		if sum%11 != 0 {
+			return "", ErrInvalidISBN
+		}
+		isbn13 := "978" + isbn[:9]
+		return isbn13 + string(isbn13CheckDigit(isbn13)), nil
+	case 13:
+		for _, r := range isbn {
+			if r < '0' || r > '9' {
+				return "", ErrInvalidISBN
+			}
+		}
+		if isbn13CheckDigit(isbn[:12]) != isbn[12] {
+			return "", ErrInvalidISBN
+		}
+		return isbn, nil
+	default:
+		return "", ErrInvalidISBN
+	}
+}
+
+// ISBN13To10 returns the ISBN-10 form of a normalized ISBN-13. only ISBN-13s
+// with the 978 prefix have one.
+func ISBN13To10(isbn13 string) (string, bool) {
+	if len(isbn13) != 13 || !strings.HasPrefix(isbn13, "978") {
+		return "", false
+	}
+	sum := 0
+	for i := 0; i < 9; i++ {
+		sum += (10 - i) * int(isbn13[3+i]-'0')
+	}
+	check := (11 - sum%11) % 11
+	if check == 10 {
+		return isbn13[3:12] + "X", true
+	}
+	return isbn13[3:12] + string(byte('0'+check)), true
+}
+
+// isbn13CheckDigit computes the check digit for the first 12 digits of an ISBN-13.
+func isbn13CheckDigit(digits string) byte {
+	sum := 0
+	for i := 0; i < 12; i++ {
+		d := int(digits[i] - '0')
+		if i%2 == 1 {
+			d *= 3
+		}
+		sum += d
+	}
+	return byte('0' + (10-sum%10)%10)
+}
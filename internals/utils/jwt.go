@@ -8,11 +8,19 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 )
 
-func GenerateJwtToken(id int, username string) (string, error) {
+const (
+	AccessTokenTTL  = time.Minute * 15
+	RefreshTokenTTL = time.Hour * 24 * 30
+)
+
+// GenerateJwtToken creates a short-lived access token bound to the refresh
+// token family it was issued with, so revoking the family revokes the token.
+func GenerateJwtToken(id int, role string, familyId int) (string, error) {
 	claims := jwt.MapClaims{
-		"id":    id,
-		"admin": false,
-		"exp":   time.Now().Add(time.Hour * 72).Unix(),
+		"id":   id,
+		"role": role,
+		"fid":  familyId,
+		"exp":  time.Now().Add(AccessTokenTTL).Unix(),
 	}
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 	tokenStr, err := token.SignedString([]byte(os.Getenv("JWT_SECRET")))
@@ -33,3 +41,27 @@ func GetUserIdFromContext(c *fiber.Ctx) (int, bool) {
 	}
 	return int(id), true
 }
+
+func GetUserRoleFromContext(c *fiber.Ctx) (string, bool) {
+	claims, ok := c.Locals("user").(*jwt.Token).Claims.(jwt.MapClaims)
+	if !ok {
+		return "", false
+	}
+	role, ok := claims["role"].(string)
+	if !ok {
+		return "", false
+	}
+	return role, true
+}
+
+func GetTokenFamilyIdFromContext(c *fiber.Ctx) (int, bool) {
+	claims, ok := c.Locals("user").(*jwt.Token).Claims.(jwt.MapClaims)
+	if !ok {
+		return 0, false
+	}
+	fid, ok := claims["fid"].(float64)
+	if !ok {
+		return 0, false
+	}
+	return int(fid), true
+}
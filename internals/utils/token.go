@@ -0,0 +1,29 @@
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"time"
+)
+
+const (
+	PasswordResetTokenTTL     = time.Hour
+	EmailVerificationTokenTTL = time.Hour * 24
+)
+
+// GenerateOpaqueToken returns a random url-safe token to be handed to the client.
+// only its hash (see HashToken) should be persisted.
+func GenerateOpaqueToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
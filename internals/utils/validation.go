@@ -28,10 +28,17 @@ func imgEncoding(fl validator.FieldLevel) bool {
 	return regexp.MustCompile(`^image/(png|jpg|jpeg)$`).MatchString(encoding)
 }
 
+// validIsbn accepts ISBN-10s and ISBN-13s with a correct check digit.
+func validIsbn(fl validator.FieldLevel) bool {
+	_, err := NormalizeISBN(fl.Field().String())
+	return err == nil
+}
+
 func ValidateRequest(req any) map[string]string {
 	Validator.RegisterValidation("startsWithLetter", startsWithLetter)
 	Validator.RegisterValidation("notBlank", notBlank)
 	Validator.RegisterValidation("imgEncoding", imgEncoding)
+	Validator.RegisterValidation("validIsbn", validIsbn)
 	if err := Validator.Struct(req); err != nil {
 		errors := make(map[string]string)
 		for _, err := range err.(validator.ValidationErrors) {